@@ -0,0 +1,329 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+// Command kapeta-rabbitmq provisions the topology of a RabbitMQ block without starting a service.
+//
+// Usage:
+//
+//	kapeta-rabbitmq plan    -file kapeta.yml -vhost <vhost> [connection flags]
+//	kapeta-rabbitmq apply   -file kapeta.yml -vhost <vhost> [connection flags]
+//	kapeta-rabbitmq destroy -file kapeta.yml -vhost <vhost> -yes [connection flags]
+//	kapeta-rabbitmq export  -file kapeta.yml -vhost <vhost> [-o definitions.json]
+//
+// plan lists the exchanges, queues and bindings that are missing or conflict with the broker.
+// apply declares them and the policies of the block. destroy deletes them again.
+// export writes RabbitMQ definitions that can be imported with rabbitmqctl import_definitions.
+//
+// The block definition can be YAML or JSON. Use -file - to read it from stdin.
+// The broker is reached through the management API.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kapetacom/sdk-go-config/providers"
+	"github.com/kapetacom/sdk-go-rabbitmq/rabbitmq"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+)
+
+const usage = `Usage: kapeta-rabbitmq <command> [flags]
+
+Commands:
+  plan     Show the changes needed to provision the block topology
+  apply    Provision the block topology and policies
+  destroy  Delete the block topology and policies
+  export   Write the block topology as RabbitMQ definitions
+
+Run kapeta-rabbitmq <command> -h for the flags of a command.
+`
+
+type options struct {
+	file     string
+	vhost    string
+	host     string
+	port     int
+	username string
+	password string
+	https    bool
+	caCert   string
+	insecure bool
+	yes      bool
+	output   string
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	err := run(os.Args[1], os.Args[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kapeta-rabbitmq %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func run(command string, args []string) error {
+	switch command {
+	case "plan", "apply", "destroy", "export":
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command")
+	}
+
+	opts := &options{}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&opts.file, "file", "kapeta.yml", "block definition, YAML or JSON. Use - for stdin")
+	flags.StringVar(&opts.vhost, "vhost", "", "vhost of the block instance (required)")
+	if command == "export" {
+		flags.StringVar(&opts.output, "o", "-", "output file. Use - for stdout")
+	} else {
+		flags.StringVar(&opts.host, "host", "localhost", "broker hostname")
+		flags.IntVar(&opts.port, "port", 0, "management API port. Defaults to 15672, or 15671 with -https")
+		flags.StringVar(&opts.username, "username", "guest", "management API username")
+		flags.StringVar(&opts.password, "password", "guest", "management API password")
+		flags.BoolVar(&opts.https, "https", false, "connect to the management API using https")
+		flags.StringVar(&opts.caCert, "ca-cert", "", "PEM encoded CA bundle used to verify the broker")
+		flags.BoolVar(&opts.insecure, "insecure", false, "skip verification of the broker certificate")
+	}
+	if command == "destroy" {
+		flags.BoolVar(&opts.yes, "yes", false, "confirm deleting the topology, including all queued messages")
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+	if opts.vhost == "" {
+		return fmt.Errorf("missing required flag: -vhost")
+	}
+
+	block, err := readBlockDefinition(opts.file)
+	if err != nil {
+		return err
+	}
+	topology, err := rabbitmq.ResolveTopology(&block.Spec)
+	if err != nil {
+		return fmt.Errorf("invalid block definition: %v", err)
+	}
+
+	if command == "export" {
+		return export(opts, block, topology)
+	}
+
+	client, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	switch command {
+	case "plan":
+		return plan(ctx, client, opts.vhost, block, topology)
+	case "apply":
+		return apply(ctx, client, opts.vhost, block, topology)
+	default:
+		if !opts.yes {
+			return fmt.Errorf("destroy deletes all queued messages. Pass -yes to confirm")
+		}
+		return destroy(ctx, client, opts.vhost, topology)
+	}
+}
+
+// readBlockDefinition reads the block from a YAML or JSON file.
+// YAML is decoded to a map first so the JSON tags of the block types apply.
+func readBlockDefinition(file string) (*rabbitmq.BlockDefinition, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading block definition: %v", err)
+	}
+
+	var raw map[string]any
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing block definition: %v", err)
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing block definition: %v", err)
+	}
+	block := &rabbitmq.BlockDefinition{}
+	err = json.Unmarshal(encoded, block)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding block definition: %v", err)
+	}
+	return block, nil
+}
+
+func newClient(opts *options) (*rabbitmq.RabbitRESTClient, error) {
+	protocol := "http"
+	if opts.https {
+		protocol = "https"
+	}
+	operator := &providers.InstanceOperator{
+		Hostname: opts.host,
+		Ports: map[string]providers.InstanceOperatorPort{
+			"management": {Protocol: protocol, Port: opts.port},
+		},
+		Credentials: map[string]any{
+			"username": opts.username,
+			"password": opts.password,
+		},
+	}
+	if !opts.https {
+		return rabbitmq.NewRabbitRESTClient(operator), nil
+	}
+
+	tlsOptions := &rabbitmq.TLSOptions{
+		Enabled:            true,
+		CACertFile:         opts.caCert,
+		InsecureSkipVerify: opts.insecure,
+	}
+	tlsConfig, err := tlsOptions.TLSConfig(opts.host)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring tls: %v", err)
+	}
+	return rabbitmq.NewRabbitRESTClientWithTLS(operator, tlsConfig), nil
+}
+
+func plan(ctx context.Context, client *rabbitmq.RabbitRESTClient, vhost string, block *rabbitmq.BlockDefinition, topology *rabbitmq.Topology) error {
+	exists, err := vhostExists(ctx, client, vhost)
+	if err != nil {
+		return err
+	}
+	changes, err := topology.Plan(ctx, client, vhost)
+	if err != nil {
+		return err
+	}
+	var drift []rabbitmq.PolicyDrift
+	if exists {
+		drift, err = rabbitmq.CheckPolicies(ctx, client, vhost, &block.Spec)
+	} else {
+		fmt.Printf("add vhost %s\n", vhost)
+		drift, err = missingPolicies(vhost, block, topology)
+	}
+	if err != nil {
+		return err
+	}
+	printChanges(changes)
+	for _, policy := range drift {
+		fmt.Println(policy)
+	}
+	if exists && len(changes) == 0 && len(drift) == 0 {
+		fmt.Println("No changes")
+	}
+	return nil
+}
+
+// missingPolicies returns the policies of the block as missing, for a vhost that does not exist yet
+func missingPolicies(vhost string, block *rabbitmq.BlockDefinition, topology *rabbitmq.Topology) ([]rabbitmq.PolicyDrift, error) {
+	definitions, err := topology.Export(vhost, &block.Spec)
+	if err != nil {
+		return nil, err
+	}
+	drift := make([]rabbitmq.PolicyDrift, 0, len(definitions.Policies))
+	for _, policy := range definitions.Policies {
+		drift = append(drift, rabbitmq.PolicyDrift{
+			Name: policy.Name,
+			Expected: &rabbitmq.PolicySettings{
+				Pattern:    policy.Pattern,
+				ApplyTo:    policy.ApplyTo,
+				Priority:   policy.Priority,
+				Definition: policy.Definition,
+			},
+		})
+	}
+	return drift, nil
+}
+
+func apply(ctx context.Context, client *rabbitmq.RabbitRESTClient, vhost string, block *rabbitmq.BlockDefinition, topology *rabbitmq.Topology) error {
+	changes, err := topology.Apply(ctx, client, vhost)
+	if err != nil {
+		printChanges(changes)
+		return err
+	}
+	drift, err := rabbitmq.ApplyPolicies(ctx, client, vhost, &block.Spec)
+	if err != nil {
+		return err
+	}
+	printChanges(changes)
+	for _, policy := range drift {
+		fmt.Println(policy)
+	}
+	fmt.Printf("Applied %d changes to vhost %s\n", len(changes)+len(drift), vhost)
+	return nil
+}
+
+func destroy(ctx context.Context, client *rabbitmq.RabbitRESTClient, vhost string, topology *rabbitmq.Topology) error {
+	exists, err := vhostExists(ctx, client, vhost)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		fmt.Printf("Vhost %s does not exist\n", vhost)
+		return nil
+	}
+	err = topology.Destroy(ctx, client, vhost)
+	if err != nil {
+		return err
+	}
+	// Applying an empty block removes all policies managed by Kapeta
+	_, err = rabbitmq.ApplyPolicies(ctx, client, vhost, &rabbitmq.BlockSpec{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Destroyed topology in vhost %s\n", vhost)
+	return nil
+}
+
+func export(opts *options, block *rabbitmq.BlockDefinition, topology *rabbitmq.Topology) error {
+	definitions, err := topology.Export(opts.vhost, &block.Spec)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.MarshalIndent(definitions, "", "  ")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+	if opts.output == "-" {
+		_, err = os.Stdout.Write(encoded)
+		return err
+	}
+	return os.WriteFile(opts.output, encoded, 0644)
+}
+
+func vhostExists(ctx context.Context, client *rabbitmq.RabbitRESTClient, vhost string) (bool, error) {
+	_, err := client.GetVHost(ctx, vhost)
+	if rabbitmq.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get vhost: %s. Error: %v", vhost, err)
+	}
+	return true, nil
+}
+
+func printChanges(changes []rabbitmq.TopologyChange) {
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Arguments are optional queue or exchange arguments, keyed by their RabbitMQ name.
+// See https://www.rabbitmq.com/docs/queues#optional-arguments
+type Arguments map[string]any
+
+type argumentKind string
+
+const (
+	argumentInt    argumentKind = "integer"
+	argumentString argumentKind = "string"
+	argumentBool   argumentKind = "boolean"
+)
+
+type argumentSpec struct {
+	kind argumentKind
+	// min is the smallest allowed integer value
+	min int64
+	// max is the largest allowed integer value. No limit if 0
+	max int64
+	// values are the allowed string values. Any value is allowed if empty
+	values []string
+	// queueTypes are the queue types that support the argument. All types if empty
+	queueTypes []string
+}
+
+// queueArgumentSpecs are the known queue arguments.
+// x-queue-type is left out so the queue type is always set and validated through QueueSpec.QueueType
+var queueArgumentSpecs = map[string]argumentSpec{
+	"x-message-ttl":                   {kind: argumentInt},
+	"x-expires":                       {kind: argumentInt, min: 1},
+	"x-max-length":                    {kind: argumentInt},
+	"x-max-length-bytes":              {kind: argumentInt},
+	"x-overflow":                      {kind: argumentString, values: []string{"drop-head", "reject-publish", "reject-publish-dlx"}},
+	"x-dead-letter-exchange":          {kind: argumentString},
+	"x-dead-letter-routing-key":       {kind: argumentString},
+	"x-dead-letter-strategy":          {kind: argumentString, values: []string{"at-most-once", "at-least-once"}},
+	"x-max-priority":                  {kind: argumentInt, min: 1, max: 255},
+	"x-queue-mode":                    {kind: argumentString, values: []string{"default", "lazy"}},
+	"x-queue-version":                 {kind: argumentInt, min: 1, max: 2},
+	"x-single-active-consumer":        {kind: argumentBool},
+	"x-queue-leader-locator":          {kind: argumentString, values: []string{"client-local", "balanced"}},
+	"x-queue-master-locator":          {kind: argumentString, values: []string{"client-local", "balanced", "min-masters", "random"}},
+	"x-delivery-limit":                {kind: argumentInt, queueTypes: []string{QueueTypeQuorum}},
+	"x-max-age":                       {kind: argumentString, queueTypes: []string{QueueTypeStream}},
+	"x-quorum-initial-group-size":     {kind: argumentInt, min: 1, queueTypes: []string{QueueTypeQuorum}},
+	"x-initial-cluster-size":          {kind: argumentInt, min: 1, queueTypes: []string{QueueTypeStream}},
+	"x-stream-max-segment-size-bytes": {kind: argumentInt, min: 1, queueTypes: []string{QueueTypeStream}},
+}
+
+var exchangeArgumentSpecs = map[string]argumentSpec{
+	"alternate-exchange": {kind: argumentString},
+	// x-consistent-hash exchanges hash a header or property instead of the routing key
+	"hash-header":   {kind: argumentString},
+	"hash-property": {kind: argumentString, values: []string{"message_id", "correlation_id", "timestamp"}},
+}
+
+// toTable validates the arguments against the known argument names and types
+// and converts them to the types expected by the broker
+func (a Arguments) toTable(known map[string]argumentSpec) (rmq.Table, error) {
+	table := rmq.Table{}
+	for name, value := range a {
+		spec, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown argument %s. Expected one of: %s", name, strings.Join(argumentNames(known), ", "))
+		}
+		converted, err := spec.convert(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %s: %v", name, err)
+		}
+		table[name] = converted
+	}
+	return table, nil
+}
+
+// validateQueueTypes checks that the queue type supports the arguments
+func (a Arguments) validateQueueTypes(queueType string) error {
+	if queueType == "" {
+		queueType = QueueTypeClassic
+	}
+	for _, name := range argumentNames(queueArgumentSpecs) {
+		spec := queueArgumentSpecs[name]
+		if _, ok := a[name]; ok && len(spec.queueTypes) > 0 && !containsString(spec.queueTypes, queueType) {
+			return fmt.Errorf("argument %s is only supported for %s queues", name, strings.Join(spec.queueTypes, ", "))
+		}
+	}
+	return nil
+}
+
+func (s argumentSpec) convert(value any) (any, error) {
+	switch s.kind {
+	case argumentInt:
+		number, err := toInt64(value)
+		if err != nil {
+			return nil, err
+		}
+		if number < s.min || (s.max > 0 && number > s.max) {
+			if s.max > 0 {
+				return nil, fmt.Errorf("%d is not between %d and %d", number, s.min, s.max)
+			}
+			return nil, fmt.Errorf("%d is less than %d", number, s.min)
+		}
+		return number, nil
+	case argumentString:
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, got %T", value)
+		}
+		if len(s.values) > 0 && !containsString(s.values, text) {
+			return nil, fmt.Errorf("expected one of %s, got %q", strings.Join(s.values, ", "), text)
+		}
+		return text, nil
+	case argumentBool:
+		flag, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected a boolean, got %T", value)
+		}
+		return flag, nil
+	}
+	return nil, fmt.Errorf("unsupported argument type: %s", s.kind)
+}
+
+// toInt64 accepts the integer types and integral floats as they are decoded from JSON
+func toInt64(value any) (int64, error) {
+	switch number := value.(type) {
+	case int:
+		return int64(number), nil
+	case int32:
+		return int64(number), nil
+	case int64:
+		return number, nil
+	case json.Number:
+		return number.Int64()
+	case float64:
+		if number != math.Trunc(number) || number > math.MaxInt64 || number < math.MinInt64 {
+			return 0, fmt.Errorf("expected an integer, got %v", number)
+		}
+		return int64(number), nil
+	}
+	return 0, fmt.Errorf("expected an integer, got %T", value)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func argumentNames(known map[string]argumentSpec) []string {
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mergeArguments adds the arguments derived from the typed spec fields to the table.
+// Setting the same argument in both places is an error.
+func mergeArguments(table rmq.Table, derived rmq.Table) error {
+	for name, value := range derived {
+		if _, ok := table[name]; ok {
+			return fmt.Errorf("argument %s is also set by the spec", name)
+		}
+		table[name] = value
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArgumentsToTable(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments string
+		table     rmq.Table
+		err       string
+	}{
+		{
+			name:      "decoded from JSON",
+			arguments: `{"x-message-ttl": 60000, "x-overflow": "reject-publish", "x-single-active-consumer": true}`,
+			table:     rmq.Table{"x-message-ttl": int64(60000), "x-overflow": "reject-publish", "x-single-active-consumer": true},
+		},
+		{
+			name:      "empty",
+			arguments: `{}`,
+			table:     rmq.Table{},
+		},
+		{
+			name:      "unknown argument",
+			arguments: `{"x-unknown": 1}`,
+			err:       "unknown argument x-unknown",
+		},
+		{
+			name:      "queue type is set through the spec",
+			arguments: `{"x-queue-type": "quorum"}`,
+			err:       "unknown argument x-queue-type",
+		},
+		{
+			name:      "fractional integer",
+			arguments: `{"x-message-ttl": 1.5}`,
+			err:       "invalid argument x-message-ttl: expected an integer, got 1.5",
+		},
+		{
+			name:      "integer out of range",
+			arguments: `{"x-max-priority": 256}`,
+			err:       "invalid argument x-max-priority: 256 is not between 1 and 255",
+		},
+		{
+			name:      "integer below min",
+			arguments: `{"x-expires": 0}`,
+			err:       "invalid argument x-expires: 0 is less than 1",
+		},
+		{
+			name:      "string value not allowed",
+			arguments: `{"x-overflow": "drop-tail"}`,
+			err:       `invalid argument x-overflow: expected one of drop-head, reject-publish, reject-publish-dlx, got "drop-tail"`,
+		},
+		{
+			name:      "wrong type",
+			arguments: `{"x-single-active-consumer": "yes"}`,
+			err:       "invalid argument x-single-active-consumer: expected a boolean, got string",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var arguments Arguments
+			err := json.Unmarshal([]byte(test.arguments), &arguments)
+			if err != nil {
+				t.Fatalf("error decoding arguments: %v", err)
+			}
+			table, err := arguments.toTable(queueArgumentSpecs)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("toTable() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("toTable() = %v", err)
+			}
+			if !reflect.DeepEqual(table, test.table) {
+				t.Errorf("toTable() = %v, want %v", table, test.table)
+			}
+		})
+	}
+}
+
+func TestToInt64(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  any
+		number int64
+		err    bool
+	}{
+		{name: "int", value: 5, number: 5},
+		{name: "int32", value: int32(-5), number: -5},
+		{name: "int64", value: int64(1) << 40, number: 1 << 40},
+		{name: "json number", value: json.Number("42"), number: 42},
+		{name: "integral float", value: 3.0, number: 3},
+		{name: "fractional float", value: 3.5, err: true},
+		{name: "float out of range", value: 1e19, err: true},
+		{name: "fractional json number", value: json.Number("4.2"), err: true},
+		{name: "string", value: "5", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			number, err := toInt64(test.value)
+			if test.err {
+				if err == nil {
+					t.Fatalf("toInt64() = %d, want an error", number)
+				}
+				return
+			}
+			if err != nil || number != test.number {
+				t.Errorf("toInt64() = %d, %v, want %d", number, err, test.number)
+			}
+		})
+	}
+}
+
+func TestArgumentsValidateQueueTypes(t *testing.T) {
+	tests := []struct {
+		name      string
+		queueType string
+		arguments Arguments
+		err       string
+	}{
+		{name: "classic", arguments: Arguments{"x-max-length": 10}},
+		{name: "delivery limit on quorum", queueType: QueueTypeQuorum, arguments: Arguments{"x-delivery-limit": 5}},
+		{name: "max age on stream", queueType: QueueTypeStream, arguments: Arguments{"x-max-age": "7D"}},
+		{name: "delivery limit on classic", arguments: Arguments{"x-delivery-limit": 5}, err: "argument x-delivery-limit is only supported for quorum queues"},
+		{name: "delivery limit on stream", queueType: QueueTypeStream, arguments: Arguments{"x-delivery-limit": 5}, err: "argument x-delivery-limit is only supported for quorum queues"},
+		{name: "max age on quorum", queueType: QueueTypeQuorum, arguments: Arguments{"x-max-age": "7D"}, err: "argument x-max-age is only supported for stream queues"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.arguments.validateQueueTypes(test.queueType)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("validateQueueTypes() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("validateQueueTypes() error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestAsQueueArguments(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue QueueResource
+		args  rmq.Table
+		err   string
+	}{
+		{
+			name:  "arguments and spec fields",
+			queue: testQueue("orders", QueueSpec{Durable: true, QueueType: QueueTypeQuorum, DeliveryLimit: 3, Arguments: Arguments{"x-max-length": 10}}),
+			args:  rmq.Table{"x-max-length": int64(10), "x-queue-type": QueueTypeQuorum, "x-delivery-limit": 3},
+		},
+		{
+			name:  "argument also set by the spec",
+			queue: testQueue("orders", QueueSpec{Durable: true, MaxLengthBytes: 100, Arguments: Arguments{"x-max-length-bytes": 10}}),
+			err:   "queue orders: argument x-max-length-bytes is also set by the spec",
+		},
+		{
+			name:  "dead-letter argument also set by the spec",
+			queue: testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{}, Arguments: Arguments{"x-dead-letter-exchange": "other"}}),
+			err:   "queue orders: argument x-dead-letter-exchange is also set by the spec",
+		},
+		{
+			name:  "argument not supported by the queue type",
+			queue: testQueue("orders", QueueSpec{Durable: true, Arguments: Arguments{"x-delivery-limit": 3}}),
+			err:   "argument x-delivery-limit is only supported for quorum queues: orders",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options, err := asQueue(test.queue)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("asQueue() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("asQueue() = %v", err)
+			}
+			if !reflect.DeepEqual(options.Args, test.args) {
+				t.Errorf("asQueue() args = %v, want %v", options.Args, test.args)
+			}
+		})
+	}
+}
+
+func TestAsExchangeArguments(t *testing.T) {
+	exchange := testExchange("events")
+	exchange.Spec.Arguments = Arguments{"alternate-exchange": "unrouted"}
+	options, err := asExchange(&exchange)
+	if err != nil {
+		t.Fatalf("asExchange() = %v", err)
+	}
+	if !reflect.DeepEqual(options.Args, rmq.Table{"alternate-exchange": "unrouted"}) {
+		t.Errorf("asExchange() args = %v", options.Args)
+	}
+
+	exchange.Spec.Arguments = Arguments{"x-message-ttl": 1000}
+	_, err = asExchange(&exchange)
+	if err == nil || !strings.Contains(err.Error(), "exchange events: unknown argument x-message-ttl") {
+		t.Errorf("asExchange() error = %v, want unknown argument", err)
+	}
+}
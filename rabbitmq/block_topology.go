@@ -0,0 +1,259 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"sort"
+)
+
+// Topology is every exchange, queue and binding declared by a block, in dependency order.
+// Exclusive queues are left out since they only exist while their consumer is connected.
+type Topology struct {
+	Exchanges []*rmq.ExchangeOptions
+	Queues    []*rmq.QueueOptions
+	Bindings  []*rmq.Binding
+}
+
+// ResolveTopology resolves the topology the consumers and publishers of the block would declare
+func ResolveTopology(blockSpec *BlockSpec) (*Topology, error) {
+	topology := &Topology{}
+	exchanges := map[string]bool{}
+	queues := map[string]bool{}
+	bindings := map[string]bool{}
+	add := func(declared *declarations) {
+		for _, exchange := range declared.exchanges {
+			if !exchanges[exchange.Name] {
+				exchanges[exchange.Name] = true
+				topology.Exchanges = append(topology.Exchanges, exchange)
+			}
+		}
+		for _, queue := range declared.queues {
+			if queue.Name != "" && !queues[queue.Name] {
+				queues[queue.Name] = true
+				topology.Queues = append(topology.Queues, queue)
+			}
+		}
+		for _, binding := range declared.bindings {
+			if binding.DestinationName == "" {
+				continue
+			}
+			key := bindingKey(asRESTBinding("", binding))
+			if !bindings[key] {
+				bindings[key] = true
+				topology.Bindings = append(topology.Bindings, binding)
+			}
+		}
+	}
+
+	for _, exchange := range blockSpec.Consumers {
+		declared, err := resolveExchangeDeclarations(blockSpec, exchange)
+		if err != nil {
+			return nil, err
+		}
+		add(declared)
+	}
+	for _, queue := range blockSpec.Providers {
+		declared, err := resolveQueueDeclarations(blockSpec, queue)
+		if err != nil {
+			return nil, err
+		}
+		add(declared)
+	}
+	return topology, nil
+}
+
+func (t *Topology) declarations() *declarations {
+	return &declarations{
+		exchanges: t.Exchanges,
+		queues:    t.Queues,
+		bindings:  t.Bindings,
+	}
+}
+
+// Plan compares the topology with the vhost. A missing vhost is treated as empty
+func (t *Topology) Plan(ctx context.Context, client *RabbitRESTClient, vhost string) ([]TopologyChange, error) {
+	return planDeclarations(ctx, client, vhost, t.declarations())
+}
+
+// Apply creates the vhost if needed and declares the topology through the management API.
+// Nothing is changed if the plan has conflicts. Orphaned bindings are deleted.
+func (t *Topology) Apply(ctx context.Context, client *RabbitRESTClient, vhost string) ([]TopologyChange, error) {
+	changes, err := t.Plan(ctx, client, vhost)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		if change.Action == TopologyConflict {
+			return changes, fmt.Errorf("can not apply topology with conflicts: %s", change)
+		}
+	}
+
+	_, err = client.GetVHost(ctx, vhost)
+	if IsNotFound(err) {
+		err = client.PutVHost(ctx, vhost, VHostSettings{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure vhost: %s. Error: %v", vhost, err)
+	}
+
+	for _, change := range changes {
+		switch {
+		case change.Resource == TopologyBinding && change.Action == TopologyOrphan:
+			err = client.DeleteBinding(ctx, vhost, *change.Binding)
+		case change.Resource == TopologyBinding:
+			err = client.CreateBinding(ctx, vhost, *change.Binding)
+		case change.Resource == TopologyExchange:
+			err = t.declareExchange(ctx, client, vhost, change.Name)
+		case change.Resource == TopologyQueue:
+			err = t.declareQueue(ctx, client, vhost, change.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply %s: %v", change, err)
+		}
+	}
+	return changes, nil
+}
+
+func (t *Topology) declareExchange(ctx context.Context, client *RabbitRESTClient, vhost, name string) error {
+	for _, exchange := range t.Exchanges {
+		if exchange.Name == name {
+			return client.DeclareExchange(ctx, vhost, name, ExchangeSettings{
+				Type:       exchange.Kind,
+				Durable:    exchange.Durable,
+				AutoDelete: exchange.AutoDelete,
+				Internal:   exchange.Internal,
+				Arguments:  normalizeJSON(exchange.Args),
+			})
+		}
+	}
+	return fmt.Errorf("exchange not found: %s", name)
+}
+
+func (t *Topology) declareQueue(ctx context.Context, client *RabbitRESTClient, vhost, name string) error {
+	for _, queue := range t.Queues {
+		if queue.Name == name {
+			return client.DeclareQueue(ctx, vhost, name, QueueSettings{
+				Durable:    queue.Durable,
+				AutoDelete: queue.AutoDelete,
+				Arguments:  normalizeJSON(queue.Args),
+			})
+		}
+	}
+	return fmt.Errorf("queue not found: %s", name)
+}
+
+// Destroy deletes the bindings, queues and exchanges of the topology from the vhost.
+// Deleting a queue also deletes its messages. Missing resources are ignored.
+func (t *Topology) Destroy(ctx context.Context, client *RabbitRESTClient, vhost string) error {
+	existing, err := client.ListBindings(ctx, vhost)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list bindings in vhost: %s. Error: %v", vhost, err)
+	}
+	for i := len(t.Bindings) - 1; i >= 0; i-- {
+		key := bindingKey(asRESTBinding(vhost, t.Bindings[i]))
+		for _, binding := range existing {
+			if bindingKey(binding) != key {
+				continue
+			}
+			err = client.DeleteBinding(ctx, vhost, binding)
+			if err != nil && !IsNotFound(err) {
+				return fmt.Errorf("failed to delete binding %s: %v", describeBinding(binding), err)
+			}
+		}
+	}
+	for i := len(t.Queues) - 1; i >= 0; i-- {
+		err = client.DeleteQueue(ctx, vhost, t.Queues[i].Name)
+		if err != nil && !IsNotFound(err) {
+			return fmt.Errorf("failed to delete queue %s: %v", t.Queues[i].Name, err)
+		}
+	}
+	for i := len(t.Exchanges) - 1; i >= 0; i-- {
+		err = client.DeleteExchange(ctx, vhost, t.Exchanges[i].Name)
+		if err != nil && !IsNotFound(err) {
+			return fmt.Errorf("failed to delete exchange %s: %v", t.Exchanges[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// Definitions is the RabbitMQ definitions format that can be imported
+// with rabbitmqctl import_definitions or the management UI
+type Definitions struct {
+	VHosts    []VHost           `json:"vhosts"`
+	Exchanges []Exchange        `json:"exchanges"`
+	Queues    []QueueDefinition `json:"queues"`
+	Bindings  []Binding         `json:"bindings"`
+	Policies  []Policy          `json:"policies"`
+}
+
+// QueueDefinition is a queue in the definitions format
+type QueueDefinition struct {
+	Name       string         `json:"name"`
+	VHost      string         `json:"vhost"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Arguments  map[string]any `json:"arguments"`
+}
+
+// Export returns the topology and the policies of the block spec as definitions for the vhost
+func (t *Topology) Export(vhost string, blockSpec *BlockSpec) (*Definitions, error) {
+	policies, err := resolvePolicies(blockSpec)
+	if err != nil {
+		return nil, err
+	}
+	definitions := &Definitions{
+		VHosts:    []VHost{{Name: vhost}},
+		Exchanges: make([]Exchange, 0, len(t.Exchanges)),
+		Queues:    make([]QueueDefinition, 0, len(t.Queues)),
+		Bindings:  make([]Binding, 0, len(t.Bindings)),
+		Policies:  make([]Policy, 0, len(policies)),
+	}
+	for _, exchange := range t.Exchanges {
+		definitions.Exchanges = append(definitions.Exchanges, Exchange{
+			Name:       exchange.Name,
+			VHost:      vhost,
+			Type:       exchange.Kind,
+			Durable:    exchange.Durable,
+			AutoDelete: exchange.AutoDelete,
+			Internal:   exchange.Internal,
+			Arguments:  normalizeJSON(exchange.Args),
+		})
+	}
+	for _, queue := range t.Queues {
+		definitions.Queues = append(definitions.Queues, QueueDefinition{
+			Name:       queue.Name,
+			VHost:      vhost,
+			Durable:    queue.Durable,
+			AutoDelete: queue.AutoDelete,
+			Arguments:  normalizeJSON(queue.Args),
+		})
+	}
+	for _, binding := range t.Bindings {
+		definitions.Bindings = append(definitions.Bindings, asRESTBinding(vhost, binding))
+	}
+
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		policy := policies[name]
+		definitions.Policies = append(definitions.Policies, Policy{
+			Name:       name,
+			VHost:      vhost,
+			Pattern:    policy.Pattern,
+			ApplyTo:    policy.ApplyTo,
+			Priority:   policy.Priority,
+			Definition: policy.Definition,
+		})
+	}
+	return definitions, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"mime"
+	"reflect"
+	"sync"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgPack  = "application/msgpack"
+	ContentTypeRaw      = "application/octet-stream"
+)
+
+// Codec encodes and decodes message payloads for a content type
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var codecs = struct {
+	lock   sync.RWMutex
+	byType map[string]Codec
+}{
+	byType: map[string]Codec{},
+}
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(ProtobufCodec{})
+	RegisterCodec(MsgPackCodec{})
+	RegisterCodec(RawCodec{})
+	RegisterCodecAlias("application/protobuf", ProtobufCodec{})
+	RegisterCodecAlias("application/x-msgpack", MsgPackCodec{})
+}
+
+// RegisterCodec registers the codec for its content type, replacing any existing codec
+func RegisterCodec(codec Codec) {
+	RegisterCodecAlias(codec.ContentType(), codec)
+}
+
+// RegisterCodecAlias registers the codec for an additional content type
+func RegisterCodecAlias(contentType string, codec Codec) {
+	codecs.lock.Lock()
+	defer codecs.lock.Unlock()
+	codecs.byType[contentType] = codec
+}
+
+// GetCodec returns the codec registered for the content type. Parameters such as charset are ignored
+func GetCodec(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type %q: %v", contentType, err)
+	}
+	codecs.lock.RLock()
+	defer codecs.lock.RUnlock()
+	codec, ok := codecs.byType[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type: %s", mediaType)
+	}
+	return codec, nil
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec encodes proto.Message values. When decoding into a pointer to
+// a nil message pointer a new message is allocated.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec expected a proto.Message, got %T", v)
+	}
+	return proto.Marshal(message)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v any) error {
+	if message, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, message)
+	}
+
+	// Handle **Message as used by generic consumers of message pointer types
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Pointer && !value.IsNil() && value.Elem().Kind() == reflect.Pointer {
+		target := value.Elem()
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		if message, ok := target.Interface().(proto.Message); ok {
+			return proto.Unmarshal(data, message)
+		}
+	}
+	return fmt.Errorf("protobuf codec expected a proto.Message, got %T", v)
+}
+
+type MsgPackCodec struct{}
+
+func (MsgPackCodec) ContentType() string {
+	return ContentTypeMsgPack
+}
+
+func (MsgPackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgPackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// RawCodec passes []byte payloads through as-is
+type RawCodec struct{}
+
+func (RawCodec) ContentType() string {
+	return ContentTypeRaw
+}
+
+func (RawCodec) Marshal(v any) ([]byte, error) {
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("raw codec expected []byte, got %T", v)
+	}
+	return data, nil
+}
+
+func (RawCodec) Unmarshal(data []byte, v any) error {
+	target, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec expected *[]byte, got %T", v)
+	}
+	*target = append((*target)[:0], data...)
+	return nil
+}
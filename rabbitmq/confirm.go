@@ -0,0 +1,118 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"log/slog"
+	"sync"
+)
+
+// confirmIdHeader is used to correlate returned messages with the publish that sent them
+const confirmIdHeader = "x-kapeta-confirm-id"
+
+type ConfirmationStatus string
+
+const (
+	// ConfirmationAcked the broker has taken responsibility for the message
+	ConfirmationAcked ConfirmationStatus = "acked"
+	// ConfirmationNacked the broker could not take responsibility for the message
+	ConfirmationNacked ConfirmationStatus = "nacked"
+	// ConfirmationReturned the message was acked but could not be routed to any queue.
+	// Returns are reported on a best effort basis, see PublishWithConfirmation
+	ConfirmationReturned ConfirmationStatus = "returned"
+)
+
+// PublishConfirmation is the result of publishing a message to a single exchange
+type PublishConfirmation struct {
+	Exchange string
+	Status   ConfirmationStatus
+	// Return is set when the message was returned as unroutable
+	Return *rmq.Return
+}
+
+// maxFinishedConfirmations is the number of finished confirmations remembered to log late returns
+const maxFinishedConfirmations = 1024
+
+// returnTracker correlates basic.return notifications with pending confirmations.
+// The underlying publisher calls the return handler in a new goroutine, so a return
+// can arrive after the confirmation has been classified. Those returns are logged
+// with the status that was reported.
+type returnTracker struct {
+	lock     sync.Mutex
+	logger   *slog.Logger
+	pending  map[string]bool
+	returned map[string]*rmq.Return
+	// finished is the reported status of recent confirmations, oldest first in finishedOrder
+	finished      map[string]ConfirmationStatus
+	finishedOrder []string
+}
+
+func newReturnTracker(logger *slog.Logger) *returnTracker {
+	return &returnTracker{
+		logger:   logger,
+		pending:  map[string]bool{},
+		returned: map[string]*rmq.Return{},
+		finished: map[string]ConfirmationStatus{},
+	}
+}
+
+func (t *returnTracker) track(confirmId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending[confirmId] = true
+}
+
+func (t *returnTracker) handle(r rmq.Return) {
+	confirmId, ok := r.Headers[confirmIdHeader].(string)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.pending[confirmId] {
+		t.returned[confirmId] = &r
+		return
+	}
+	status, ok := t.finished[confirmId]
+	if !ok || status == "" {
+		status = "unknown"
+	}
+	t.logger.Warn("Message was returned after its confirmation was reported",
+		"confirmId", confirmId,
+		"status", status,
+		"replyCode", r.ReplyCode,
+		"replyText", r.ReplyText,
+		"routingKey", r.RoutingKey,
+	)
+}
+
+// done stops tracking the message and returns the return notification if one was received.
+// The status is the one reported for the message, or empty if the outcome is unknown
+func (t *returnTracker) done(confirmId string, status ConfirmationStatus) *rmq.Return {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	returned := t.returned[confirmId]
+	delete(t.pending, confirmId)
+	delete(t.returned, confirmId)
+
+	if len(t.finishedOrder) == maxFinishedConfirmations {
+		delete(t.finished, t.finishedOrder[0])
+		t.finishedOrder = t.finishedOrder[1:]
+	}
+	t.finished[confirmId] = status
+	t.finishedOrder = append(t.finishedOrder, confirmId)
+	return returned
+}
+
+func newConfirmId() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/kapetacom/sdk-go-config/providers"
+	"github.com/mitchellh/mapstructure"
+	amqp "github.com/rabbitmq/amqp091-go"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	schemeAMQP  = "amqp"
+	schemeAMQPS = "amqps"
+
+	paramHeartbeat         = "heartbeat"
+	paramChannelMax        = "channel_max"
+	paramFrameMax          = "frame_max"
+	paramConnectionTimeout = "connection_timeout"
+)
+
+// ConnectionParams are the optional AMQP URI query parameters.
+// See https://www.rabbitmq.com/docs/uri-query-parameters
+// The instance operator can provide them in options.connection.
+type ConnectionParams struct {
+	// Heartbeat is the heartbeat timeout in seconds. 0 uses the server value
+	Heartbeat int `json:"heartbeat,omitempty" mapstructure:"heartbeat"`
+	// ChannelMax is the maximum number of channels. 0 means no limit
+	ChannelMax int `json:"channel_max,omitempty" mapstructure:"channel_max"`
+	// FrameMax is the maximum frame size in bytes. 0 means no limit
+	FrameMax int `json:"frame_max,omitempty" mapstructure:"frame_max"`
+	// ConnectionTimeout is the TCP connection timeout in milliseconds. 0 uses the library default
+	ConnectionTimeout int `json:"connection_timeout,omitempty" mapstructure:"connection_timeout"`
+}
+
+// ConnectionConfig holds everything needed to open an AMQP connection.
+// Use Validate before connecting - URL and Connect assume a valid config.
+type ConnectionConfig struct {
+	// Scheme is either amqp or amqps
+	Scheme   string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	VHost    string
+	Params   ConnectionParams
+	// TLS is required for amqps
+	TLS *tls.Config
+	// ExternalAuth uses the EXTERNAL SASL mechanism instead of username and password
+	ExternalAuth bool
+}
+
+// ParseConnectionURL parses an AMQP URI including the supported query parameters
+func ParseConnectionURL(rawURL string) (*ConnectionConfig, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection url: %v", err)
+	}
+	config := &ConnectionConfig{
+		Scheme: parsed.Scheme,
+		Host:   parsed.Hostname(),
+		VHost:  "/",
+	}
+	if parsed.Port() != "" {
+		config.Port, err = strconv.Atoi(parsed.Port())
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in connection url: %s", parsed.Port())
+		}
+	} else if parsed.Scheme == schemeAMQPS {
+		config.Port = 5671
+	} else {
+		config.Port = 5672
+	}
+	if parsed.User != nil {
+		config.Username = parsed.User.Username()
+		config.Password, _ = parsed.User.Password()
+	}
+	if len(parsed.Path) > 1 {
+		config.VHost = parsed.Path[1:]
+	}
+
+	query := parsed.Query()
+	for name, target := range map[string]*int{
+		paramHeartbeat:         &config.Params.Heartbeat,
+		paramChannelMax:        &config.Params.ChannelMax,
+		paramFrameMax:          &config.Params.FrameMax,
+		paramConnectionTimeout: &config.Params.ConnectionTimeout,
+	} {
+		if !query.Has(name) {
+			continue
+		}
+		*target, err = strconv.Atoi(query.Get(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s in connection url: %s", name, query.Get(name))
+		}
+	}
+
+	if config.Scheme == schemeAMQPS {
+		config.TLS = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: config.Host,
+		}
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// newConnectionConfig builds the connection config for the instance operator.
+// The operator credentials are used if credentials is nil.
+func newConnectionConfig(operator *providers.InstanceOperator, vhost string, credentials *providers.DefaultCredentials, tlsOptions *TLSOptions, tlsConfig *tls.Config) (*ConnectionConfig, error) {
+	config := &ConnectionConfig{
+		Scheme: schemeAMQP,
+		Host:   operator.Hostname,
+		Port:   operator.Ports["amqp"].Port,
+		VHost:  vhost,
+		TLS:    tlsConfig,
+	}
+	if tlsConfig != nil {
+		config.Scheme = schemeAMQPS
+		if operator.Ports["amqps"].Port != 0 {
+			config.Port = operator.Ports["amqps"].Port
+		}
+	}
+
+	if tlsOptions != nil && tlsOptions.ExternalAuth {
+		config.ExternalAuth = true
+	} else {
+		if credentials == nil {
+			var err error
+			credentials, err = getCredentials(operator)
+			if err != nil {
+				return nil, err
+			}
+		}
+		config.Username = credentials.Username
+		config.Password = credentials.Password
+	}
+
+	if rawParams, ok := operator.Options["connection"]; ok {
+		err := mapstructure.WeakDecode(rawParams, &config.Params)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding operator connection options: %v", err)
+		}
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks that the config can be used to connect
+func (c *ConnectionConfig) Validate() error {
+	switch c.Scheme {
+	case schemeAMQP, schemeAMQPS:
+	default:
+		return fmt.Errorf("invalid connection scheme %q. Expected %s or %s", c.Scheme, schemeAMQP, schemeAMQPS)
+	}
+	if c.Host == "" {
+		return fmt.Errorf("connection host is missing")
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("%s port not found or invalid: %d", c.Scheme, c.Port)
+	}
+	if c.Scheme == schemeAMQPS && c.TLS == nil {
+		return fmt.Errorf("amqps requires a tls config")
+	}
+	if c.ExternalAuth {
+		if c.Scheme != schemeAMQPS {
+			return fmt.Errorf("external auth requires amqps")
+		}
+	} else if c.Username == "" {
+		return fmt.Errorf("connection username is missing")
+	}
+	if c.VHost == "" {
+		return fmt.Errorf("connection vhost is missing")
+	}
+	if c.Params.Heartbeat < 0 {
+		return fmt.Errorf("invalid %s: %d", paramHeartbeat, c.Params.Heartbeat)
+	}
+	if c.Params.ChannelMax < 0 || c.Params.ChannelMax > 65535 {
+		return fmt.Errorf("invalid %s: %d", paramChannelMax, c.Params.ChannelMax)
+	}
+	if c.Params.FrameMax < 0 {
+		return fmt.Errorf("invalid %s: %d", paramFrameMax, c.Params.FrameMax)
+	}
+	if c.Params.ConnectionTimeout < 0 {
+		return fmt.Errorf("invalid %s: %d", paramConnectionTimeout, c.Params.ConnectionTimeout)
+	}
+	return nil
+}
+
+// URL returns the AMQP URI with escaped credentials and vhost
+func (c *ConnectionConfig) URL() string {
+	connectionURL := &url.URL{
+		Scheme: c.Scheme,
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		// The vhost is a single path segment, so "/" must be escaped as well
+		Path:    "/" + c.VHost,
+		RawPath: "/" + url.PathEscape(c.VHost),
+	}
+	if !c.ExternalAuth {
+		connectionURL.User = url.UserPassword(c.Username, c.Password)
+	}
+
+	query := url.Values{}
+	if c.Params.Heartbeat > 0 {
+		query.Set(paramHeartbeat, strconv.Itoa(c.Params.Heartbeat))
+	}
+	if c.Params.ChannelMax > 0 {
+		query.Set(paramChannelMax, strconv.Itoa(c.Params.ChannelMax))
+	}
+	if c.Params.FrameMax > 0 {
+		query.Set(paramFrameMax, strconv.Itoa(c.Params.FrameMax))
+	}
+	if c.Params.ConnectionTimeout > 0 {
+		query.Set(paramConnectionTimeout, strconv.Itoa(c.Params.ConnectionTimeout))
+	}
+	connectionURL.RawQuery = query.Encode()
+	return connectionURL.String()
+}
+
+// Redacted returns the URL without the password, for logging
+func (c *ConnectionConfig) Redacted() string {
+	connectionURL, err := url.Parse(c.URL())
+	if err != nil {
+		return ""
+	}
+	return connectionURL.Redacted()
+}
+
+// amqpConfig returns the client config. The amqp client does not read
+// the query parameters from the URL so they are applied here.
+func (c *ConnectionConfig) amqpConfig() rmq.Config {
+	config := rmq.Config{
+		Vhost:           c.VHost,
+		TLSClientConfig: c.TLS,
+		ChannelMax:      c.Params.ChannelMax,
+		FrameSize:       c.Params.FrameMax,
+		Heartbeat:       time.Duration(c.Params.Heartbeat) * time.Second,
+	}
+	if c.ExternalAuth {
+		// The identity is taken from the client certificate
+		config.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	}
+	if c.Params.ConnectionTimeout > 0 {
+		config.Dial = amqp.DefaultDial(time.Duration(c.Params.ConnectionTimeout) * time.Millisecond)
+	}
+	return config
+}
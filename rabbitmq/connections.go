@@ -0,0 +1,145 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/kapetacom/sdk-go-config/providers"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"log/slog"
+	"sync"
+)
+
+type connectionKey struct {
+	instanceId string
+	vhost      string
+}
+
+type sharedConnection struct {
+	// ready is closed when the connection attempt has finished and conn or err is set
+	ready chan struct{}
+	conn  *rmq.Conn
+	err   error
+	refs  int
+}
+
+// ConnectionManager shares connections per instance and vhost between publishers and consumers.
+// Connections are reference counted and closed when the last user releases them.
+type ConnectionManager struct {
+	options     ConnectionManagerOptions
+	lock        sync.Mutex
+	connections map[connectionKey]*sharedConnection
+}
+
+type ConnectionManagerOptions struct {
+	// TLS overrides the TLS settings of the instance operators
+	TLS *TLSOptions
+	// DisableUserProvisioning connects with the operator credentials instead of
+	// a user with permissions limited to the exchanges and queues of the block
+	DisableUserProvisioning bool
+	// PolicyMode controls how the policies declared in the block are applied.
+	// Defaults to PolicyModeApply
+	PolicyMode PolicyMode
+}
+
+var defaultConnectionManager = NewConnectionManager()
+
+// DefaultConnectionManager returns the manager used when no manager is set in the options
+func DefaultConnectionManager() *ConnectionManager {
+	return defaultConnectionManager
+}
+
+func NewConnectionManager() *ConnectionManager {
+	return NewConnectionManagerWithOptions(ConnectionManagerOptions{})
+}
+
+func NewConnectionManagerWithOptions(options ConnectionManagerOptions) *ConnectionManager {
+	return &ConnectionManager{
+		options:     options,
+		connections: map[connectionKey]*sharedConnection{},
+	}
+}
+
+// Acquire returns a connection to the instance, connecting and ensuring the vhost
+// and instance user exist only if there is no open connection yet.
+// Concurrent calls for the same instance wait for a single connection attempt.
+// The permissions of the user are limited to the exchanges and queues of the block spec.
+// The release function must be called once when the connection is no longer used.
+func (m *ConnectionManager) Acquire(config providers.ConfigProvider, instanceId string, blockSpec *BlockSpec, logger *slog.Logger) (*rmq.Conn, func() error, error) {
+	key := connectionKey{
+		instanceId: instanceId,
+		vhost:      instanceVHost(instanceId),
+	}
+
+	// The lock is only held for the bookkeeping so a slow broker does not block other instances
+	m.lock.Lock()
+	shared, ok := m.connections[key]
+	if !ok {
+		shared = &sharedConnection{ready: make(chan struct{})}
+		m.connections[key] = shared
+	}
+	shared.refs++
+	m.lock.Unlock()
+
+	if !ok {
+		conn, err := connectToInstance(config, instanceId, blockSpec, m.options, loggerOrDefault(logger))
+		m.lock.Lock()
+		shared.conn, shared.err = conn, err
+		if err != nil && m.connections[key] == shared {
+			delete(m.connections, key)
+		}
+		m.lock.Unlock()
+		close(shared.ready)
+	} else {
+		<-shared.ready
+	}
+
+	if shared.err != nil {
+		m.lock.Lock()
+		shared.refs--
+		m.lock.Unlock()
+		return nil, nil, shared.err
+	}
+
+	released := false
+	release := func() error {
+		m.lock.Lock()
+		if released {
+			m.lock.Unlock()
+			return nil
+		}
+		released = true
+		closing := m.release(key, shared)
+		m.lock.Unlock()
+		if closing == nil {
+			return nil
+		}
+		err := closing.Close()
+		if err != nil {
+			return fmt.Errorf("error closing connection to %s: %v", key.instanceId, err)
+		}
+		return nil
+	}
+	return shared.conn, release, nil
+}
+
+// release drops a reference and returns the connection if it must be closed.
+// Must be called with the lock held.
+func (m *ConnectionManager) release(key connectionKey, shared *sharedConnection) *rmq.Conn {
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+	if m.connections[key] == shared {
+		delete(m.connections, key)
+	}
+	return shared.conn
+}
+
+func connectionManagerOrDefault(manager *ConnectionManager) *ConnectionManager {
+	if manager == nil {
+		return defaultConnectionManager
+	}
+	return manager
+}
@@ -3,12 +3,15 @@
 package rabbitmq
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/kapetacom/sdk-go-config/providers"
 	amqp "github.com/rabbitmq/amqp091-go"
 	rmq "github.com/wagslane/go-rabbitmq"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"sync"
+	"time"
 )
 
 type Action = rmq.Action
@@ -26,9 +29,104 @@ const (
 
 type MessageHandler[T any] func(message T, delivery amqp.Delivery) (Action, error)
 
+// ContextMessageHandler is a MessageHandler that receives a context for each delivery.
+// The context is cancelled if the handler has not finished when the consumer shuts down.
+type ContextMessageHandler[T any] func(ctx context.Context, message T, delivery amqp.Delivery) (Action, error)
+
 type Consumer = rmq.Consumer
 
+// ContextConsumer is a consumer that keeps track of running handlers
+// to allow them to finish before shutting down.
+type ContextConsumer struct {
+	consumer *rmq.Consumer
+	tracker  *deliveryTracker
+	retrier  *retrier
+	// release returns the connection to the ConnectionManager
+	release   func() error
+	closeOnce sync.Once
+}
+
+// Shutdown stops handling new deliveries and waits for running handlers to finish.
+// Deliveries that arrive in the meantime are not handled and are returned to the queue
+// when the consumer is closed. If the context expires before the handlers have finished,
+// the handler contexts are cancelled and the unfinished deliveries are nacked and requeued.
+// The consumer is closed when Shutdown returns.
+func (c *ContextConsumer) Shutdown(ctx context.Context) error {
+	err := c.tracker.shutdown(ctx)
+	c.close()
+	return err
+}
+
+// Close closes the consumer immediately without waiting for running handlers.
+// It is safe to call Close more than once and after Shutdown.
+func (c *ContextConsumer) Close() {
+	c.close()
+}
+
+func (c *ContextConsumer) close() {
+	c.closeOnce.Do(func() {
+		c.consumer.Close()
+		c.tracker.stop()
+		if c.retrier != nil {
+			c.retrier.close()
+		}
+		err := c.release()
+		if err != nil {
+			c.tracker.logger.Warn("Failed to release connection", "error", err)
+		}
+	})
+}
+
+// ConsumerOptions controls how messages are fetched and handled.
+// Unset options fall back to the values in the QueueSpec and then to the library defaults.
+type ConsumerOptions struct {
+	// Concurrency is the number of goroutines handling messages. 0 uses the QueueSpec
+	Concurrency int
+	// PrefetchCount is the number of unacknowledged messages the broker will deliver.
+	// 0 means no limit. nil uses the QueueSpec and then defaults to 10
+	PrefetchCount *int
+	// PrefetchSize is not implemented by RabbitMQ and must be 0
+	PrefetchSize int
+	// GlobalQoS applies the prefetch settings to all consumers on the connection.
+	// nil uses the QueueSpec
+	GlobalQoS *bool
+	// StreamOffset is where to start reading when consuming a stream queue
+	StreamOffset *StreamOffset
+	// DisableValidation skips validating incoming payloads against the queue payload type.
+	// Only JSON payloads are validated, since other codecs do not use the field names of the entity
+	DisableValidation bool
+	Tracing           TracingOptions
+	// Metrics records handled messages and durations when set
+	Metrics *Metrics
+	// Logger is used for all log output of the consumer. Defaults to slog.Default()
+	Logger *slog.Logger
+	// Connections shares connections with other publishers and consumers.
+	// Defaults to DefaultConnectionManager()
+	Connections *ConnectionManager
+}
+
 func CreateConsumer[T any](config providers.ConfigProvider, resourceName string, callback MessageHandler[T]) (*rmq.Consumer, error) {
+	return CreateConsumerWithOptions[T](config, resourceName, callback, ConsumerOptions{})
+}
+
+// CreateConsumerWithOptions creates a consumer for the resource.
+// The connection of the returned consumer is never released, use
+// CreateContextConsumerWithOptions to be able to close it.
+func CreateConsumerWithOptions[T any](config providers.ConfigProvider, resourceName string, callback MessageHandler[T], consumerOptions ConsumerOptions) (*rmq.Consumer, error) {
+	consumer, err := CreateContextConsumerWithOptions[T](config, resourceName, func(_ context.Context, message T, delivery amqp.Delivery) (Action, error) {
+		return callback(message, delivery)
+	}, consumerOptions)
+	if err != nil {
+		return nil, err
+	}
+	return consumer.consumer, nil
+}
+
+func CreateContextConsumer[T any](config providers.ConfigProvider, resourceName string, callback ContextMessageHandler[T]) (*ContextConsumer, error) {
+	return CreateContextConsumerWithOptions[T](config, resourceName, callback, ConsumerOptions{})
+}
+
+func CreateContextConsumerWithOptions[T any](config providers.ConfigProvider, resourceName string, callback ContextMessageHandler[T], consumerOptions ConsumerOptions) (*ContextConsumer, error) {
 	instance, err := config.GetInstanceForConsumer(resourceName)
 	if err != nil {
 		return nil, err
@@ -39,11 +137,111 @@ func CreateConsumer[T any](config providers.ConfigProvider, resourceName string,
 		return nil, fmt.Errorf("error decoding block spec: %v", err)
 	}
 
-	conn, err := ConnectToInstance(config, instance.InstanceId)
+	logger := loggerOrDefault(consumerOptions.Logger).With(
+		logInstanceId, config.GetInstanceId(),
+		logResourceName, resourceName,
+	)
+
+	queue, err := findConsumerQueue(instance, blockSpec, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	queueName := queue.Metadata.Name
+	logger = logger.With(logVHost, instance.InstanceId, logQueue, queueName)
+	consumerOptions = withQueueConsumerOptions(consumerOptions, queue)
+	if consumerOptions.PrefetchSize != 0 {
+		return nil, fmt.Errorf("prefetch size is not supported by RabbitMQ for queue: %s", queueName)
+	}
+	var streamOffset any
+	if consumerOptions.StreamOffset != nil {
+		if queue.Spec.QueueType != QueueTypeStream {
+			return nil, fmt.Errorf("stream offset is only supported for streams: %s", queueName)
+		}
+		streamOffset, err = consumerOptions.StreamOffset.value()
+		if err != nil {
+			return nil, fmt.Errorf("%v for stream: %s", err, queueName)
+		}
+	}
+
+	declared, err := resolveQueueDeclarations(blockSpec, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, release, err := connectionManagerOrDefault(consumerOptions.Connections).Acquire(config, instance.InstanceId, blockSpec, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	retrier, err := newRetrier(conn, queue, logger)
+	if err != nil {
+		_ = release()
+		return nil, err
+	}
+
+	consumerTag := config.GetInstanceId() + "_" + resourceName
+	tracker := newDeliveryTracker(logger)
+
+	options := []func(*rmq.ConsumerOptions){
+		rmq.WithConsumerOptionsLogger(newRmqLogger(logger)),
+		rmq.WithConsumerOptionsConsumerName(consumerTag),
+		rmq.WithConsumerQueues(dereferenceSlice(declared.queues)),
+		rmq.WithConsumerBindings(dereferenceSlice(declared.bindings)),
+		rmq.WithConsumerExchanges(dereferenceSlice(declared.exchanges)),
+	}
+	if consumerOptions.Concurrency > 0 {
+		options = append(options, rmq.WithConsumerOptionsConcurrency(consumerOptions.Concurrency))
+	}
+	if consumerOptions.PrefetchCount != nil {
+		options = append(options, rmq.WithConsumerOptionsQOSPrefetch(*consumerOptions.PrefetchCount))
+	}
+	if consumerOptions.GlobalQoS != nil && *consumerOptions.GlobalQoS {
+		options = append(options, rmq.WithConsumerOptionsQOSGlobal)
+	}
+	if streamOffset != nil {
+		options = append(options, func(options *rmq.ConsumerOptions) {
+			options.RabbitConsumerOptions.Args["x-stream-offset"] = streamOffset
+		})
+	}
+
+	handler := &deliveryHandler[T]{
+		resource: resourceName,
+		queue:    queueName,
+		callback: callback,
+		tracker:  tracker,
+		retrier:  retrier,
+		tracer:   newTracer(consumerOptions.Tracing, config.GetInstanceId()),
+		metrics:  consumerOptions.Metrics,
+		logger:   logger,
+	}
+	if !consumerOptions.DisableValidation {
+		handler.validator = newPayloadValidator(queue.Spec.PayloadType, blockSpec.Entities)
+	}
+
+	consumer, err := rmq.NewConsumer(
+		conn,
+		createHandler(handler),
+		declared.queues[0].Name,
+		options...,
+	)
 	if err != nil {
+		if retrier != nil {
+			retrier.close()
+		}
+		_ = release()
 		return nil, err
 	}
 
+	return &ContextConsumer{
+		consumer: consumer,
+		tracker:  tracker,
+		retrier:  retrier,
+		release:  release,
+	}, nil
+}
+
+// findConsumerQueue returns the queue connected to the consumer resource
+func findConsumerQueue(instance *providers.BlockInstanceDetails, blockSpec *BlockSpec, resourceName string) (QueueResource, error) {
 	queueDefinitions := make([]QueueResource, 0)
 
 	for _, connection := range instance.Connections {
@@ -57,60 +255,133 @@ func CreateConsumer[T any](config providers.ConfigProvider, resourceName string,
 	}
 
 	if len(queueDefinitions) == 0 {
-		return nil, fmt.Errorf("no queues found for provider: %s", resourceName)
+		return QueueResource{}, fmt.Errorf("no queues found for provider: %s", resourceName)
 	}
 
 	if len(queueDefinitions) > 1 {
-		return nil, fmt.Errorf("multiple defined queues found. Only 1 expected for provider: %s", resourceName)
+		return QueueResource{}, fmt.Errorf("multiple defined queues found. Only 1 expected for provider: %s", resourceName)
 	}
+	return queueDefinitions[0], nil
+}
 
-	queue := queueDefinitions[0]
-	queueName := queue.Metadata.Name
-	queueOptions := asQueue(queue)
-
-	bindings, exchanges, err := resolveBindings(blockSpec, rmq.BindingTypeQueue, queueName)
-
-	if queueOptions.Name == "" {
-		// Exclusive queues need to have the destination name set to an empty string
-		for _, binding := range bindings {
-			binding.DestinationName = ""
-		}
+// withQueueConsumerOptions fills unset options from the queue spec.
+// Options set in code always take precedence over the spec
+func withQueueConsumerOptions(options ConsumerOptions, queue QueueResource) ConsumerOptions {
+	if options.Concurrency == 0 {
+		options.Concurrency = queue.Spec.Concurrency
 	}
-
-	if err != nil {
-		return nil, fmt.Errorf("error resolving bindings: %v", err)
+	if options.PrefetchCount == nil && queue.Spec.PrefetchCount > 0 {
+		prefetchCount := queue.Spec.PrefetchCount
+		options.PrefetchCount = &prefetchCount
+	}
+	if options.PrefetchSize == 0 {
+		options.PrefetchSize = queue.Spec.PrefetchSize
+	}
+	if options.GlobalQoS == nil {
+		globalQoS := queue.Spec.PrefetchGlobal
+		options.GlobalQoS = &globalQoS
+	}
+	if options.StreamOffset == nil {
+		options.StreamOffset = queue.Spec.StreamOffset
 	}
+	return options
+}
 
-	consumerTag := config.GetInstanceId() + "_" + resourceName
+func actionName(action rmq.Action) string {
+	switch action {
+	case rmq.Ack:
+		return "ack"
+	case rmq.NackDiscard:
+		return "nack_discard"
+	case rmq.NackRequeue:
+		return "nack_requeue"
+	case rmq.Manual:
+		return "manual"
+	}
+	return "unknown"
+}
 
-	return rmq.NewConsumer(
-		conn,
-		createHandler(callback),
-		queueOptions.Name,
-		rmq.WithConsumerOptionsLogging,
-		rmq.WithConsumerOptionsConsumerName(consumerTag),
-		rmq.WithConsumerQueue(queueOptions),
-		rmq.WithConsumerBindings(dereferenceSlice(bindings)),
-		rmq.WithConsumerExchanges(dereferenceSlice(exchanges)),
-	)
+// deliveryHandler decodes deliveries and passes them to the callback
+type deliveryHandler[T any] struct {
+	resource  string
+	queue     string
+	callback  ContextMessageHandler[T]
+	tracker   *deliveryTracker
+	retrier   *retrier
+	validator *payloadValidator
+	tracer    *tracer
+	metrics   *Metrics
+	logger    *slog.Logger
 }
 
-func createHandler[T any](callback MessageHandler[T]) func(message rmq.Delivery) (action rmq.Action) {
+func createHandler[T any](handler *deliveryHandler[T]) func(message rmq.Delivery) (action rmq.Action) {
 	return func(message rmq.Delivery) (action rmq.Action) {
-		if message.Delivery.ContentType != "application/json" {
-			log.Printf("message was not in json format")
-			return rmq.NackDiscard
-		}
-		var payload T
-		err := json.Unmarshal(message.Delivery.Body, &payload)
-		if err != nil {
-			log.Printf("Failed to parse message from %s: %s", message.Delivery.AppId, err)
-			return rmq.NackDiscard
+		delivery, ok := handler.tracker.begin(message.Delivery)
+		if !ok {
+			// Closed - the broker returns the message to the queue
+			return rmq.Manual
 		}
-		action, err = callback(payload, message.Delivery)
+		defer handler.tracker.end(delivery)
+		return handler.handle(delivery, message)
+	}
+}
+
+func (h *deliveryHandler[T]) handle(delivery *trackedDelivery, message rmq.Delivery) rmq.Action {
+	started := time.Now()
+	ctx, span := h.tracer.startConsume(delivery.ctx, h.queue, message.Delivery)
+	action, failed, err := h.process(ctx, message)
+	if !h.tracker.claim(delivery) {
+		// Shutdown gave up waiting and requeued the delivery, so it must not be settled again
+		span.SetAttributes(attribute.String("kapeta.action", actionName(rmq.NackRequeue)))
+		endSpan(span, err)
+		return rmq.Manual
+	}
+	if failed {
+		action = h.fail(ctx, message, err)
+	}
+	span.SetAttributes(attribute.String("kapeta.action", actionName(action)))
+	endSpan(span, err)
+	h.metrics.observeDelivery(h.resource, h.queue, actionName(action), started)
+	return action
+}
+
+// process decodes and validates the delivery and passes it to the callback.
+// failed is true if the callback returned an error
+func (h *deliveryHandler[T]) process(ctx context.Context, message rmq.Delivery) (action rmq.Action, failed bool, err error) {
+	logger := h.logger.With(logDeliveryTag, message.Delivery.DeliveryTag)
+	codec, err := GetCodec(message.Delivery.ContentType)
+	if err != nil {
+		logger.Error("Unsupported message", "appId", message.Delivery.AppId, "error", err)
+		return rmq.NackDiscard, false, err
+	}
+	// JSON is validated before it is decoded so missing and mistyped fields are detected
+	if h.validator != nil && codec.ContentType() == ContentTypeJSON {
+		err = h.validator.validateJSON(message.Delivery.Body)
 		if err != nil {
-			return rmq.NackRequeue
+			logger.Error("Rejected invalid message", "appId", message.Delivery.AppId, "error", err)
+			return rmq.NackDiscard, false, err
 		}
-		return action
 	}
+	var payload T
+	err = codec.Unmarshal(message.Delivery.Body, &payload)
+	if err != nil {
+		logger.Error("Failed to parse message", "appId", message.Delivery.AppId, "error", err)
+		return rmq.NackDiscard, false, err
+	}
+	action, err = h.callback(ctx, payload, message.Delivery)
+	return action, err != nil, err
+}
+
+// fail returns the action for a delivery the callback failed to handle
+func (h *deliveryHandler[T]) fail(ctx context.Context, message rmq.Delivery, err error) rmq.Action {
+	if h.retrier != nil {
+		return h.retrier.retry(ctx, message.Delivery)
+	}
+	if message.Delivery.Redelivered {
+		// Without dead-letter settings there is nowhere to park the message
+		h.logger.Error("Message failed again after it was requeued. Discarding it",
+			logDeliveryTag, message.Delivery.DeliveryTag, "appId", message.Delivery.AppId, "error", err)
+		return rmq.NackDiscard
+	}
+	return rmq.NackRequeue
 }
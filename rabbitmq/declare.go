@@ -7,31 +7,249 @@ import (
 	"fmt"
 	"github.com/mitchellh/mapstructure"
 	rmq "github.com/wagslane/go-rabbitmq"
-	"strings"
+	"regexp"
 )
 
-func asExchange(exchange *ExchangeResource) rmq.ExchangeOptions {
+func asExchange(exchange *ExchangeResource) (rmq.ExchangeOptions, error) {
+	err := validateExchange(exchange)
+	if err != nil {
+		return rmq.ExchangeOptions{}, err
+	}
+	args, err := exchange.Spec.Arguments.toTable(exchangeArgumentSpecs)
+	if err != nil {
+		return rmq.ExchangeOptions{}, fmt.Errorf("exchange %s: %v", exchange.Metadata.Name, err)
+	}
+	if exchange.Spec.ExchangeType == ExchangeTypeDelayedMessage {
+		args["x-delayed-type"] = delayedType(exchange)
+	}
 	return rmq.ExchangeOptions{
 		Name:       exchange.Metadata.Name,
 		Durable:    exchange.Spec.Durable,
 		AutoDelete: exchange.Spec.AutoDelete,
 		Kind:       exchange.Spec.ExchangeType,
+		Args:       args,
 		Declare:    true,
-	}
+	}, nil
 }
 
-func asQueue(queue QueueResource) rmq.QueueOptions {
+func asQueue(queue QueueResource) (rmq.QueueOptions, error) {
+	err := validateQueue(queue)
+	if err != nil {
+		return rmq.QueueOptions{}, err
+	}
 	queueRequestName := queue.Metadata.Name
 	if queue.Spec.Exclusive {
 		queueRequestName = ""
 	}
+	args, err := queue.Spec.Arguments.toTable(queueArgumentSpecs)
+	if err != nil {
+		return rmq.QueueOptions{}, fmt.Errorf("queue %s: %v", queue.Metadata.Name, err)
+	}
+	derived := rmq.Table{}
+	if queue.Spec.DeadLetter != nil {
+		derived["x-dead-letter-exchange"] = deadLetterExchangeName(queue)
+		derived["x-dead-letter-routing-key"] = deadLetterRoutingKey(queue)
+	}
+	if queue.Spec.QueueType != "" {
+		derived["x-queue-type"] = queue.Spec.QueueType
+	}
+	if queue.Spec.DeliveryLimit > 0 {
+		derived["x-delivery-limit"] = queue.Spec.DeliveryLimit
+	}
+	if queue.Spec.MaxAge != "" {
+		derived["x-max-age"] = queue.Spec.MaxAge
+	}
+	if queue.Spec.MaxLengthBytes > 0 {
+		derived["x-max-length-bytes"] = queue.Spec.MaxLengthBytes
+	}
+	err = mergeArguments(args, derived)
+	if err != nil {
+		return rmq.QueueOptions{}, fmt.Errorf("queue %s: %v", queue.Metadata.Name, err)
+	}
 	return rmq.QueueOptions{
 		Name:       queueRequestName,
 		Durable:    queue.Spec.Durable,
 		AutoDelete: queue.Spec.AutoDelete,
 		Exclusive:  queue.Spec.Exclusive,
+		Args:       args,
 		Declare:    true,
+	}, nil
+}
+
+var maxAgePattern = regexp.MustCompile(`^[0-9]+(Y|M|D|h|m|s)$`)
+
+// validateQueue checks that the queue type supports the queue settings
+func validateQueue(queue QueueResource) error {
+	name := queue.Metadata.Name
+	spec := queue.Spec
+	err := validateDeadLetter(queue)
+	if err != nil {
+		return err
 	}
+	err = spec.Arguments.validateQueueTypes(spec.QueueType)
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, name)
+	}
+	switch spec.QueueType {
+	case "", QueueTypeClassic:
+		if spec.DeliveryLimit != 0 {
+			return fmt.Errorf("delivery limit is only supported for quorum queues: %s", name)
+		}
+		if spec.MaxAge != "" {
+			return fmt.Errorf("max age is only supported for streams: %s", name)
+		}
+		if spec.StreamOffset != nil {
+			return fmt.Errorf("stream offset is only supported for streams: %s", name)
+		}
+		return nil
+	case QueueTypeQuorum, QueueTypeStream:
+	default:
+		return fmt.Errorf("invalid queue type %q for queue: %s", spec.QueueType, name)
+	}
+
+	// Quorum queues and streams are replicated and always durable
+	if !spec.Durable || spec.Exclusive || spec.AutoDelete {
+		return fmt.Errorf("%s queues must be durable and can not be exclusive or auto-delete: %s", spec.QueueType, name)
+	}
+	if spec.DeliveryLimit < 0 || spec.MaxLengthBytes < 0 {
+		return fmt.Errorf("delivery limit and max length bytes can not be negative: %s", name)
+	}
+
+	if spec.QueueType == QueueTypeQuorum {
+		if spec.MaxAge != "" {
+			return fmt.Errorf("max age is only supported for streams: %s", name)
+		}
+		if spec.StreamOffset != nil {
+			return fmt.Errorf("stream offset is only supported for streams: %s", name)
+		}
+		return nil
+	}
+
+	if spec.DeliveryLimit != 0 {
+		return fmt.Errorf("delivery limit is only supported for quorum queues: %s", name)
+	}
+	if spec.DeadLetter != nil {
+		return fmt.Errorf("dead-lettering is not supported for streams: %s", name)
+	}
+	if spec.MaxAge != "" && !maxAgePattern.MatchString(spec.MaxAge) {
+		return fmt.Errorf("invalid max age %q for stream: %s. Expected a number followed by Y, M, D, h, m or s", spec.MaxAge, name)
+	}
+	if spec.StreamOffset != nil {
+		_, err := spec.StreamOffset.value()
+		if err != nil {
+			return fmt.Errorf("%v for stream: %s", err, name)
+		}
+	}
+	return nil
+}
+
+// validateDeadLetter rejects retry settings that would not be applied
+func validateDeadLetter(queue QueueResource) error {
+	spec := queue.Spec.DeadLetter
+	if spec == nil {
+		return nil
+	}
+	if spec.MaxRetries < 0 || spec.RetryDelay < 0 || spec.MaxRetryDelay < 0 {
+		return fmt.Errorf("dead-letter max retries and retry delays can not be negative: %s", queue.Metadata.Name)
+	}
+	if spec.MaxRetries > 0 && spec.RetryDelay == 0 {
+		return fmt.Errorf("dead-letter max retries requires a retry delay: %s", queue.Metadata.Name)
+	}
+	return nil
+}
+
+func deadLetterExchangeName(queue QueueResource) string {
+	if queue.Spec.DeadLetter.Exchange != "" {
+		return queue.Spec.DeadLetter.Exchange
+	}
+	return queue.Metadata.Name + ".dlx"
+}
+
+func deadLetterRoutingKey(queue QueueResource) string {
+	if queue.Spec.DeadLetter.RoutingKey != "" {
+		return queue.Spec.DeadLetter.RoutingKey
+	}
+	return queue.Metadata.Name
+}
+
+// retryQueueName returns the retry queue of the (0-based) backoff level.
+// The first level keeps the name <queue>.retry
+func retryQueueName(queue QueueResource, level int) string {
+	if level == 0 {
+		return queue.Metadata.Name + ".retry"
+	}
+	return fmt.Sprintf("%s.retry.%d", queue.Metadata.Name, level)
+}
+
+func parkingQueueName(queue QueueResource) string {
+	return queue.Metadata.Name + ".parking"
+}
+
+// resolveDeadLetter returns the dead-letter exchange, the retry and parking queues
+// and their bindings for the queue. Dead-lettered messages are routed to the parking queue.
+// There is a retry queue for each backoff level. Messages in a retry queue are sent back
+// to the queue when the TTL of the retry queue expires. A queue TTL is used rather than
+// a per-message TTL since RabbitMQ only expires messages at the head of a queue.
+func resolveDeadLetter(queue QueueResource) ([]*rmq.QueueOptions, []*rmq.ExchangeOptions, []*rmq.Binding, error) {
+	if queue.Spec.DeadLetter == nil {
+		return nil, nil, nil, nil
+	}
+	if queue.Spec.Exclusive {
+		return nil, nil, nil, fmt.Errorf("dead-lettering is not supported for exclusive queue: %s", queue.Metadata.Name)
+	}
+
+	exchangeName := deadLetterExchangeName(queue)
+	exchanges := []*rmq.ExchangeOptions{
+		{
+			Name:    exchangeName,
+			Durable: queue.Spec.Durable,
+			Kind:    "direct",
+			Declare: true,
+		},
+	}
+
+	queues := []*rmq.QueueOptions{
+		{
+			Name:    parkingQueueName(queue),
+			Durable: queue.Spec.Durable,
+			Declare: true,
+		},
+	}
+	bindings := []*rmq.Binding{
+		{
+			DestinationName: parkingQueueName(queue),
+			DestinationType: rmq.BindingTypeQueue,
+			ExchangeName:    exchangeName,
+			RoutingKey:      deadLetterRoutingKey(queue),
+			BindingOptions: rmq.BindingOptions{
+				Declare: true,
+			},
+		},
+	}
+
+	for level, delay := range retryDelays(queue.Spec.DeadLetter) {
+		queues = append(queues, &rmq.QueueOptions{
+			Name:    retryQueueName(queue, level),
+			Durable: queue.Spec.Durable,
+			Args: rmq.Table{
+				"x-message-ttl":             int32(delay.Milliseconds()),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue.Metadata.Name,
+			},
+			Declare: true,
+		})
+		bindings = append(bindings, &rmq.Binding{
+			DestinationName: retryQueueName(queue, level),
+			DestinationType: rmq.BindingTypeQueue,
+			ExchangeName:    exchangeName,
+			RoutingKey:      retryQueueName(queue, level),
+			BindingOptions: rmq.BindingOptions{
+				Declare: true,
+			},
+		})
+	}
+
+	return queues, exchanges, bindings, nil
 }
 
 func getBindingHeaders(binding ExchangeBindingSchema) (rmq.Table, error) {
@@ -59,76 +277,61 @@ func getBindingHeaders(binding ExchangeBindingSchema) (rmq.Table, error) {
 	return headers, nil
 }
 
-func resolveBindings(blockSpec *BlockSpec, destinationType rmq.BindingDestinationType, destinationName string) ([]*rmq.Binding, []*rmq.ExchangeOptions, error) {
-	exchanges := make([]*rmq.ExchangeOptions, 0)
-	bindings := make([]*rmq.Binding, 0)
-
-	for _, exchangeBindings := range blockSpec.Bindings.Exchanges {
-		var exchange *ExchangeResource
-		for _, exchangeDefinition := range blockSpec.Consumers {
-			if exchangeDefinition.Metadata.Name == exchangeBindings.Exchange {
-				exchange = &exchangeDefinition
-				break
-			}
-		}
-		if exchange == nil {
-			return nil, nil, fmt.Errorf("exchange not found for binding")
-		}
-
-		if len(exchangeBindings.Bindings) == 0 {
-			// no bindings for this exchange
-			continue
-		}
-
-		foundAnyBinding := false
-
-		for _, binding := range exchangeBindings.Bindings {
-			if !strings.EqualFold(binding.Type, string(destinationType)) ||
-				binding.Name != destinationName {
-				// not a binding for this destination
-				continue
-			}
-
-			foundAnyBinding = true
-			routingKey, ok := binding.Routing.(string)
-			if ok {
-				// routing key binding
-				bindings = append(bindings, &rmq.Binding{
-					DestinationName: destinationName,
-					DestinationType: destinationType,
-					ExchangeName:    exchange.Metadata.Name,
-					RoutingKey:      routingKey,
-					BindingOptions: rmq.BindingOptions{
-						Declare: true,
-					},
-				})
-			} else {
-				// headers binding
-				headers, err := getBindingHeaders(binding)
-				if err != nil {
-					return nil, nil, err
-				}
-
-				bindings = append(bindings, &rmq.Binding{
-					DestinationName: destinationName,
-					DestinationType: destinationType,
-					ExchangeName:    exchange.Metadata.Name,
-					BindingOptions: rmq.BindingOptions{
-						Declare: true,
-						Args:    headers,
-					},
-				})
-			}
+// asBinding returns the binding from the exchange to the destination
+func asBinding(exchange *ExchangeResource, binding ExchangeBindingSchema, destinationType rmq.BindingDestinationType) (*rmq.Binding, error) {
+	if exchange.Spec.ExchangeType == ExchangeTypeConsistentHash {
+		// The routing key of a consistent hash binding is the weight of the destination
+		weight, err := consistentHashWeight(binding.Routing)
+		if err != nil {
+			return nil, fmt.Errorf("binding %s to %s: %v", exchange.Metadata.Name, binding.Name, err)
 		}
+		return &rmq.Binding{
+			DestinationName: binding.Name,
+			DestinationType: destinationType,
+			ExchangeName:    exchange.Metadata.Name,
+			RoutingKey:      weight,
+			BindingOptions: rmq.BindingOptions{
+				Declare: true,
+			},
+		}, nil
+	}
 
-		if !foundAnyBinding {
-			continue
-		}
+	routingKey, ok := binding.Routing.(string)
+	if ok {
+		// routing key binding
+		return &rmq.Binding{
+			DestinationName: binding.Name,
+			DestinationType: destinationType,
+			ExchangeName:    exchange.Metadata.Name,
+			RoutingKey:      routingKey,
+			BindingOptions: rmq.BindingOptions{
+				Declare: true,
+			},
+		}, nil
+	}
 
-		// We only want the exchanges that we have bindings for
-		exchangeOptions := asExchange(exchange)
-		exchanges = append(exchanges, &exchangeOptions)
+	// headers binding
+	headers, err := getBindingHeaders(binding)
+	if err != nil {
+		return nil, err
 	}
+	return &rmq.Binding{
+		DestinationName: binding.Name,
+		DestinationType: destinationType,
+		ExchangeName:    exchange.Metadata.Name,
+		BindingOptions: rmq.BindingOptions{
+			Declare: true,
+			Args:    headers,
+		},
+	}, nil
+}
 
-	return bindings, exchanges, nil
+// resolveBindings returns the exchanges and bindings that route messages to the destination
+// in dependency order. See resolveTopology
+func resolveBindings(blockSpec *BlockSpec, destinationType rmq.BindingDestinationType, destinationName string) ([]*rmq.Binding, []*rmq.ExchangeOptions, error) {
+	topology, err := newTopology(blockSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return topology.resolve(destinationType, destinationName)
 }
@@ -0,0 +1,186 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"github.com/kapetacom/schemas/packages/go/model"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testQueue(name string, spec QueueSpec) QueueResource {
+	return QueueResource{ResourceWithSpec[QueueSpec]{
+		Metadata: model.ResourceMetadata{Name: name},
+		Spec:     spec,
+	}}
+}
+
+func TestResolveDeadLetter(t *testing.T) {
+	tests := []struct {
+		name        string
+		queue       QueueResource
+		exchange    string
+		queues      []string
+		routingKeys []string
+		ttls        []int32
+		err         string
+	}{
+		{
+			name:  "disabled",
+			queue: testQueue("orders", QueueSpec{Durable: true}),
+		},
+		{
+			name:        "parking only",
+			queue:       testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{}}),
+			exchange:    "orders.dlx",
+			queues:      []string{"orders.parking"},
+			routingKeys: []string{"orders"},
+		},
+		{
+			name:        "custom exchange and routing key",
+			queue:       testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{Exchange: "failed", RoutingKey: "orders.failed"}}),
+			exchange:    "failed",
+			queues:      []string{"orders.parking"},
+			routingKeys: []string{"orders.failed"},
+		},
+		{
+			name:        "retry queue per backoff level",
+			queue:       testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{MaxRetries: 3, RetryDelay: 1000}}),
+			exchange:    "orders.dlx",
+			queues:      []string{"orders.parking", "orders.retry", "orders.retry.1", "orders.retry.2"},
+			routingKeys: []string{"orders", "orders.retry", "orders.retry.1", "orders.retry.2"},
+			ttls:        []int32{1000, 2000, 4000},
+		},
+		{
+			name:  "exclusive queue",
+			queue: testQueue("orders", QueueSpec{Exclusive: true, DeadLetter: &DeadLetterSpec{}}),
+			err:   "dead-lettering is not supported for exclusive queue: orders",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queues, exchanges, bindings, err := resolveDeadLetter(test.queue)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("resolveDeadLetter() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveDeadLetter() = %v", err)
+			}
+			if test.exchange == "" {
+				if len(queues) != 0 || len(exchanges) != 0 || len(bindings) != 0 {
+					t.Fatalf("expected no dead-letter topology, got %d queues, %d exchanges and %d bindings", len(queues), len(exchanges), len(bindings))
+				}
+				return
+			}
+
+			if len(exchanges) != 1 || exchanges[0].Name != test.exchange || exchanges[0].Kind != "direct" {
+				t.Fatalf("exchanges = %+v, want direct exchange %s", exchanges, test.exchange)
+			}
+			var queueNames []string
+			var ttls []int32
+			for _, queue := range queues {
+				queueNames = append(queueNames, queue.Name)
+				if !queue.Durable {
+					t.Errorf("queue %s is not durable", queue.Name)
+				}
+				if ttl, ok := queue.Args["x-message-ttl"]; ok {
+					ttls = append(ttls, ttl.(int32))
+					if queue.Args["x-dead-letter-routing-key"] != "orders" {
+						t.Errorf("queue %s does not dead-letter back to the queue: %v", queue.Name, queue.Args)
+					}
+				}
+			}
+			if !reflect.DeepEqual(queueNames, test.queues) {
+				t.Errorf("queues = %v, want %v", queueNames, test.queues)
+			}
+			if !reflect.DeepEqual(ttls, test.ttls) {
+				t.Errorf("retry ttls = %v, want %v", ttls, test.ttls)
+			}
+			var routingKeys []string
+			for _, binding := range bindings {
+				if binding.ExchangeName != test.exchange || binding.DestinationType != rmq.BindingTypeQueue {
+					t.Errorf("unexpected binding %+v", binding)
+				}
+				routingKeys = append(routingKeys, binding.RoutingKey)
+			}
+			if !reflect.DeepEqual(routingKeys, test.routingKeys) {
+				t.Errorf("routing keys = %v, want %v", routingKeys, test.routingKeys)
+			}
+		})
+	}
+}
+
+func TestValidateQueue(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue QueueResource
+		err   string
+	}{
+		{
+			name:  "classic",
+			queue: testQueue("orders", QueueSpec{Durable: true}),
+		},
+		{
+			name:  "parking only",
+			queue: testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{}}),
+		},
+		{
+			name:  "retries",
+			queue: testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{MaxRetries: 3, RetryDelay: 1000, MaxRetryDelay: 5000}}),
+		},
+		{
+			name:  "max retries without retry delay",
+			queue: testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{MaxRetries: 3}}),
+			err:   "dead-letter max retries requires a retry delay: orders",
+		},
+		{
+			name:  "negative retry delay",
+			queue: testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{RetryDelay: -1}}),
+			err:   "dead-letter max retries and retry delays can not be negative: orders",
+		},
+		{
+			name:  "negative max retries",
+			queue: testQueue("orders", QueueSpec{Durable: true, DeadLetter: &DeadLetterSpec{MaxRetries: -1, RetryDelay: 1000}}),
+			err:   "dead-letter max retries and retry delays can not be negative: orders",
+		},
+		{
+			name:  "invalid queue type",
+			queue: testQueue("orders", QueueSpec{Durable: true, QueueType: "priority"}),
+			err:   `invalid queue type "priority" for queue: orders`,
+		},
+		{
+			name:  "delivery limit on classic queue",
+			queue: testQueue("orders", QueueSpec{Durable: true, DeliveryLimit: 5}),
+			err:   "delivery limit is only supported for quorum queues: orders",
+		},
+		{
+			name:  "quorum queue",
+			queue: testQueue("orders", QueueSpec{Durable: true, QueueType: QueueTypeQuorum, DeliveryLimit: 5}),
+		},
+		{
+			name:  "non-durable quorum queue",
+			queue: testQueue("orders", QueueSpec{QueueType: QueueTypeQuorum}),
+			err:   "quorum queues must be durable and can not be exclusive or auto-delete: orders",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateQueue(test.queue)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("validateQueue() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("validateQueue() error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
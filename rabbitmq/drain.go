@@ -0,0 +1,138 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"log/slog"
+	"sync"
+)
+
+type trackedDelivery struct {
+	delivery amqp.Delivery
+	// ctx is cancelled when the handler finishes or shutdown gives up waiting
+	ctx      context.Context
+	cancel   context.CancelFunc
+	requeued bool
+}
+
+// deliveryTracker keeps track of deliveries that are being handled
+// so that the consumer can drain them on shutdown
+type deliveryTracker struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *slog.Logger
+
+	lock     sync.Mutex
+	closing  bool
+	inflight map[*trackedDelivery]struct{}
+	wg       sync.WaitGroup
+	// stopped is closed when the consumer has been closed
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newDeliveryTracker(logger *slog.Logger) *deliveryTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &deliveryTracker{
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logger,
+		inflight: map[*trackedDelivery]struct{}{},
+		stopped:  make(chan struct{}),
+	}
+}
+
+// begin registers a delivery as running. Returns false if the consumer is shutting down.
+//
+// The consumer can not be cancelled without closing its channel, which would prevent
+// acking the running deliveries. Deliveries that arrive while shutting down are therefore
+// held until the consumer is closed, which returns them to the queue. Requeuing them
+// instead would make the broker send them straight back.
+func (t *deliveryTracker) begin(delivery amqp.Delivery) (*trackedDelivery, bool) {
+	t.lock.Lock()
+	if t.closing {
+		t.lock.Unlock()
+		<-t.stopped
+		return nil, false
+	}
+	defer t.lock.Unlock()
+	ctx, cancel := context.WithCancel(t.ctx)
+	tracked := &trackedDelivery{delivery: delivery, ctx: ctx, cancel: cancel}
+	t.inflight[tracked] = struct{}{}
+	t.wg.Add(1)
+	return tracked, true
+}
+
+// claim takes the delivery out of the deliveries that shutdown requeues, so that the
+// handler can settle it. Returns false if shutdown already requeued it
+func (t *deliveryTracker) claim(tracked *trackedDelivery) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if tracked.requeued {
+		return false
+	}
+	delete(t.inflight, tracked)
+	return true
+}
+
+// end marks the delivery as finished
+func (t *deliveryTracker) end(tracked *trackedDelivery) {
+	tracked.cancel()
+	t.lock.Lock()
+	delete(t.inflight, tracked)
+	t.lock.Unlock()
+	t.wg.Done()
+}
+
+// stop cancels all running handlers and releases the deliveries held by begin.
+// Must be called after the consumer has been closed.
+func (t *deliveryTracker) stop() {
+	t.lock.Lock()
+	t.closing = true
+	t.lock.Unlock()
+	t.cancel()
+	t.stopOnce.Do(func() {
+		close(t.stopped)
+	})
+}
+
+func (t *deliveryTracker) shutdown(ctx context.Context) error {
+	t.lock.Lock()
+	t.closing = true
+	t.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.cancel()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	requeued := 0
+	for tracked := range t.inflight {
+		if tracked.requeued {
+			continue
+		}
+		err := tracked.delivery.Nack(false, true)
+		if err != nil {
+			t.logger.Error("Failed to requeue unfinished delivery", logDeliveryTag, tracked.delivery.DeliveryTag, "error", err)
+		}
+		tracked.requeued = true
+		requeued++
+	}
+	return fmt.Errorf("%d deliveries did not finish before shutdown and were requeued: %w", requeued, ctx.Err())
+}
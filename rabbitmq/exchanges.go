@@ -0,0 +1,106 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ExchangeTypeDirect  = "direct"
+	ExchangeTypeFanout  = "fanout"
+	ExchangeTypeTopic   = "topic"
+	ExchangeTypeHeaders = "headers"
+	// ExchangeTypeDelayedMessage requires the rabbitmq_delayed_message_exchange plugin.
+	// Messages are held back for PublishOptions.Delay before they are routed
+	ExchangeTypeDelayedMessage = "x-delayed-message"
+	// ExchangeTypeConsistentHash requires the rabbitmq_consistent_hash_exchange plugin.
+	// Bindings use the weight of the destination as routing
+	ExchangeTypeConsistentHash = "x-consistent-hash"
+)
+
+// delayHeader holds the delay in ms of messages published to x-delayed-message exchanges
+const delayHeader = "x-delay"
+
+var exchangeTypes = []string{
+	ExchangeTypeDirect,
+	ExchangeTypeFanout,
+	ExchangeTypeTopic,
+	ExchangeTypeHeaders,
+	ExchangeTypeDelayedMessage,
+	ExchangeTypeConsistentHash,
+}
+
+// delayedTypes are the routing types supported by x-delayed-message exchanges
+var delayedTypes = []string{
+	ExchangeTypeDirect,
+	ExchangeTypeFanout,
+	ExchangeTypeTopic,
+	ExchangeTypeHeaders,
+}
+
+// validateExchange checks the exchange type and the settings that depend on it
+func validateExchange(exchange *ExchangeResource) error {
+	name := exchange.Metadata.Name
+	spec := exchange.Spec
+	if !containsString(exchangeTypes, spec.ExchangeType) {
+		return fmt.Errorf("invalid exchange type %q for exchange: %s. Expected one of: %s",
+			spec.ExchangeType, name, strings.Join(exchangeTypes, ", "))
+	}
+
+	if spec.ExchangeType == ExchangeTypeDelayedMessage {
+		if spec.DelayedType != "" && !containsString(delayedTypes, spec.DelayedType) {
+			return fmt.Errorf("invalid delayed type %q for exchange: %s. Expected one of: %s",
+				spec.DelayedType, name, strings.Join(delayedTypes, ", "))
+		}
+	} else if spec.DelayedType != "" {
+		return fmt.Errorf("delayed type is only supported for %s exchanges: %s", ExchangeTypeDelayedMessage, name)
+	}
+
+	if spec.ExchangeType != ExchangeTypeConsistentHash {
+		for _, argument := range []string{"hash-header", "hash-property"} {
+			if _, ok := spec.Arguments[argument]; ok {
+				return fmt.Errorf("argument %s is only supported for %s exchanges: %s", argument, ExchangeTypeConsistentHash, name)
+			}
+		}
+	}
+	return nil
+}
+
+// delayedType returns the routing type of a x-delayed-message exchange
+func delayedType(exchange *ExchangeResource) string {
+	if exchange.Spec.DelayedType != "" {
+		return exchange.Spec.DelayedType
+	}
+	return ExchangeTypeDirect
+}
+
+// consistentHashWeight returns the routing key of a binding to a consistent hash exchange.
+// The weight can be given as a number or a numeric string.
+func consistentHashWeight(routing ExchangeRouting) (string, error) {
+	var weight int
+	switch value := routing.(type) {
+	case float64:
+		if value != float64(int(value)) {
+			return "", fmt.Errorf("consistent hash weight must be an integer: %v", value)
+		}
+		weight = int(value)
+	case int:
+		weight = value
+	case string:
+		var err error
+		weight, err = strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("consistent hash weight must be an integer: %q", value)
+		}
+	default:
+		return "", fmt.Errorf("consistent hash bindings require a weight as routing")
+	}
+	if weight <= 0 {
+		return "", fmt.Errorf("consistent hash weight must be positive: %d", weight)
+	}
+	return strconv.Itoa(weight), nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"log/slog"
+)
+
+// Structured logging field names
+const (
+	logInstanceId   = "instanceId"
+	logResourceName = "resourceName"
+	logVHost        = "vhost"
+	logExchange     = "exchange"
+	logQueue        = "queue"
+	logDeliveryTag  = "deliveryTag"
+)
+
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// rmqLogger bridges the go-rabbitmq Logger interface to slog
+type rmqLogger struct {
+	logger *slog.Logger
+}
+
+var _ rmq.Logger = rmqLogger{}
+
+func newRmqLogger(logger *slog.Logger) rmqLogger {
+	return rmqLogger{logger: logger.With("component", "gorabbit")}
+}
+
+// Fatalf is logged as an error. The library stops the affected consumer or
+// publisher itself so we do not exit the process.
+func (l rmqLogger) Fatalf(format string, v ...interface{}) {
+	l.log(slog.LevelError, format, v...)
+}
+
+func (l rmqLogger) Errorf(format string, v ...interface{}) {
+	l.log(slog.LevelError, format, v...)
+}
+
+func (l rmqLogger) Warnf(format string, v ...interface{}) {
+	l.log(slog.LevelWarn, format, v...)
+}
+
+func (l rmqLogger) Infof(format string, v ...interface{}) {
+	l.log(slog.LevelInfo, format, v...)
+}
+
+func (l rmqLogger) Debugf(format string, v ...interface{}) {
+	l.log(slog.LevelDebug, format, v...)
+}
+
+func (l rmqLogger) log(level slog.Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+	l.logger.Log(ctx, level, fmt.Sprintf(format, v...))
+}
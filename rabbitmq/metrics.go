@@ -0,0 +1,104 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+const metricsNamespace = "kapeta_rabbitmq"
+
+// Metrics exposes Prometheus collectors for publishers and consumers.
+// Pass the same instance to all publishers and consumers using
+// PublisherOptions.Metrics and ConsumerOptions.Metrics.
+// A nil *Metrics disables metrics.
+type Metrics struct {
+	published       *prometheus.CounterVec
+	publishDuration *prometheus.HistogramVec
+	consumed        *prometheus.CounterVec
+	handlerDuration *prometheus.HistogramVec
+}
+
+// NewMetrics creates the collectors and registers them with the registerer.
+// The default Prometheus registerer is used if registerer is nil.
+// Calling NewMetrics again with the same registerer reuses the registered collectors.
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	metrics := &Metrics{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "published_messages_total",
+			Help:      "Number of messages published per exchange and result.",
+		}, []string{"resource", "exchange", "result"}),
+		publishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_duration_seconds",
+			Help:      "Time spent publishing a message to an exchange, including confirmation when enabled.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"resource", "exchange"}),
+		consumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "consumed_messages_total",
+			Help:      "Number of messages consumed per queue and resulting action.",
+		}, []string{"resource", "queue", "action"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Time spent handling a delivery.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"resource", "queue"}),
+	}
+
+	var err error
+	metrics.published, err = register(registerer, metrics.published)
+	if err != nil {
+		return nil, err
+	}
+	metrics.publishDuration, err = register(registerer, metrics.publishDuration)
+	if err != nil {
+		return nil, err
+	}
+	metrics.consumed, err = register(registerer, metrics.consumed)
+	if err != nil {
+		return nil, err
+	}
+	metrics.handlerDuration, err = register(registerer, metrics.handlerDuration)
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// register returns the already registered collector if an identical one was registered before
+func register[T prometheus.Collector](registerer prometheus.Registerer, collector T) (T, error) {
+	err := registerer.Register(collector)
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		existing, ok := registered.ExistingCollector.(T)
+		if ok {
+			return existing, nil
+		}
+	}
+	return collector, err
+}
+
+func (m *Metrics) observePublish(resource, exchange, result string, started time.Time) {
+	if m == nil {
+		return
+	}
+	m.published.WithLabelValues(resource, exchange, result).Inc()
+	m.publishDuration.WithLabelValues(resource, exchange).Observe(time.Since(started).Seconds())
+}
+
+func (m *Metrics) observeDelivery(resource, queue, action string, started time.Time) {
+	if m == nil {
+		return
+	}
+	m.consumed.WithLabelValues(resource, queue, action).Inc()
+	m.handlerDuration.WithLabelValues(resource, queue).Observe(time.Since(started).Seconds())
+}
@@ -0,0 +1,24 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+func TestNewMetricsRegistersOnce(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	first, err := NewMetrics(registry)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := NewMetrics(registry)
+	if err != nil {
+		t.Fatalf("unexpected error creating metrics again: %v", err)
+	}
+	if first.published != second.published || first.handlerDuration != second.handlerDuration {
+		t.Errorf("expected the registered collectors to be reused")
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutboxMessage is a stored publisher payload waiting to be relayed
+type OutboxMessage struct {
+	ID int64
+	// Payload is the JSON encoded PublisherPayload
+	Payload   []byte
+	CreatedAt time.Time
+	// Attempts is the number of times the message was nacked by the broker
+	Attempts int
+	// Error is the reason the last attempt failed
+	Error string
+}
+
+// OutboxStore persists messages until they have been confirmed by the broker
+type OutboxStore interface {
+	// Add stores a new message
+	Add(ctx context.Context, payload []byte) error
+	// Pending returns up to limit unsent messages in the order they were added.
+	// Failed messages are not returned
+	Pending(ctx context.Context, limit int) ([]OutboxMessage, error)
+	// MarkSent marks the message as delivered
+	MarkSent(ctx context.Context, id int64) error
+	// RecordFailure increments the attempts of the message and stores the reason
+	RecordFailure(ctx context.Context, id int64, reason string) error
+	// MarkFailed marks the message as failed so it is no longer relayed
+	MarkFailed(ctx context.Context, id int64, reason string) error
+}
+
+// TxOutboxStore is implemented by stores that can add messages as part of a
+// database transaction
+type TxOutboxStore interface {
+	OutboxStore
+	AddTx(ctx context.Context, tx *sql.Tx, payload []byte) error
+}
+
+type OutboxOptions struct {
+	// PollInterval is the time between checks for pending messages. Defaults to 1 second
+	PollInterval time.Duration
+	// BatchSize is the max number of messages relayed per poll. Defaults to 100
+	BatchSize int
+	// MaxAttempts is the number of times a message can be nacked by the broker
+	// before it is marked as failed. Defaults to 10
+	MaxAttempts int
+	// Logger is used for relay errors. Defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+// Outbox stores payloads in an OutboxStore and relays them through the publisher
+// using publisher confirms. Messages are delivered at least once.
+//
+// Only one relay may run per store. SQLOutboxStore elects a single relay with a lease,
+// so it is safe to start the relay on every replica. Other stores must make sure that
+// only one replica starts the relay.
+//
+// A message is marked as sent once every exchange has acked it. If an exchange nacks the
+// message it is published again on the next poll, but only to the exchanges that did not
+// ack it yet. After MaxAttempts nacks, or if the message is returned as unroutable or can
+// not be decoded, the message is marked as failed and the relay moves on. Failed messages
+// are logged and kept in the store.
+//
+// Returns of unroutable messages are best effort (see PublishWithConfirmation), so a
+// message published while no queue is bound can be marked as sent and lost. Configure an
+// alternate exchange on the exchanges of the publisher to keep unroutable messages.
+type Outbox[DataType any, Headers map[string]any, RoutingKey string] struct {
+	store OutboxStore
+	// publish is publishWithConfirmation of the publisher
+	publish func(ctx context.Context, payload PublisherPayload[DataType, Headers, RoutingKey], skip map[string]bool) ([]PublishConfirmation, error)
+	options OutboxOptions
+	// partial is the message the relay stopped at and the exchanges that acked it.
+	// It is only used by the relay goroutine
+	partial *partialDelivery
+
+	lock   sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewOutbox creates an outbox for the publisher. The publisher must be in confirm mode.
+func NewOutbox[DataType any, Headers map[string]any, RoutingKey string](
+	store OutboxStore,
+	publisher *Publisher[DataType, Headers, RoutingKey],
+	options OutboxOptions) (*Outbox[DataType, Headers, RoutingKey], error) {
+
+	if !publisher.confirm {
+		return nil, fmt.Errorf("outbox requires a publisher in confirm mode")
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = time.Second
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 100
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = 10
+	}
+	options.Logger = loggerOrDefault(options.Logger).With(logResourceName, publisher.resourceName)
+	return &Outbox[DataType, Headers, RoutingKey]{
+		store:   store,
+		publish: publisher.publishWithConfirmation,
+		options: options,
+	}, nil
+}
+
+// Add stores the payload to be published by the relay
+func (o *Outbox[DataType, Headers, RoutingKey]) Add(ctx context.Context, payload PublisherPayload[DataType, Headers, RoutingKey]) error {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding outbox payload: %v", err)
+	}
+	return o.store.Add(ctx, bytes)
+}
+
+// AddTx stores the payload as part of the transaction. The store must implement TxOutboxStore.
+func (o *Outbox[DataType, Headers, RoutingKey]) AddTx(ctx context.Context, tx *sql.Tx, payload PublisherPayload[DataType, Headers, RoutingKey]) error {
+	store, ok := o.store.(TxOutboxStore)
+	if !ok {
+		return fmt.Errorf("outbox store does not support transactions")
+	}
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding outbox payload: %v", err)
+	}
+	return store.AddTx(ctx, tx, bytes)
+}
+
+// Start starts the relay goroutine. It runs until the context is cancelled or Close is called.
+func (o *Outbox[DataType, Headers, RoutingKey]) Start(ctx context.Context) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.done != nil {
+		return
+	}
+	ctx, o.cancel = context.WithCancel(ctx)
+	o.done = make(chan struct{})
+	go o.relay(ctx, o.done)
+}
+
+// Close stops the relay and waits for it to finish
+func (o *Outbox[DataType, Headers, RoutingKey]) Close() error {
+	o.lock.Lock()
+	cancel, done := o.cancel, o.done
+	o.cancel, o.done = nil, nil
+	o.lock.Unlock()
+	if done == nil {
+		return nil
+	}
+	cancel()
+	<-done
+	return nil
+}
+
+func (o *Outbox[DataType, Headers, RoutingKey]) relay(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(o.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		err := o.relayPending(ctx)
+		if err != nil && ctx.Err() == nil {
+			o.options.Logger.Error("Failed to relay outbox messages", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// partialDelivery is a message that was acked by some of the exchanges of the publisher
+type partialDelivery struct {
+	id    int64
+	acked map[string]bool
+}
+
+// relayPending publishes pending messages in order and stops at the first message
+// that could not be delivered so that messages are not reordered
+func (o *Outbox[DataType, Headers, RoutingKey]) relayPending(ctx context.Context) error {
+	messages, err := o.store.Pending(ctx, o.options.BatchSize)
+	if err != nil {
+		return fmt.Errorf("error reading pending messages: %v", err)
+	}
+	for _, message := range messages {
+		var payload PublisherPayload[DataType, Headers, RoutingKey]
+		err = json.Unmarshal(message.Payload, &payload)
+		if err != nil {
+			err = o.markFailed(ctx, message, fmt.Sprintf("error decoding payload: %v", err))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if o.partial == nil || o.partial.id != message.ID {
+			o.partial = &partialDelivery{id: message.ID, acked: map[string]bool{}}
+		}
+		results, publishErr := o.publish(ctx, payload, o.partial.acked)
+		var returned, nacked []string
+		for _, result := range results {
+			switch result.Status {
+			case ConfirmationAcked:
+				o.partial.acked[result.Exchange] = true
+			case ConfirmationReturned:
+				returned = append(returned, describeReturn(result))
+			case ConfirmationNacked:
+				nacked = append(nacked, result.Exchange)
+			}
+		}
+
+		switch {
+		case len(returned) > 0:
+			// Routing does not change by publishing again
+			err = o.markFailed(ctx, message, fmt.Sprintf("returned as unroutable by %s", strings.Join(returned, ", ")))
+			if err != nil {
+				return err
+			}
+			continue
+		case len(nacked) > 0:
+			err = o.recordNack(ctx, message, nacked)
+			if err != nil {
+				return err
+			}
+			continue
+		case publishErr != nil:
+			// The broker could not be reached. The message is published again on the next poll
+			return fmt.Errorf("error publishing outbox message %d: %v", message.ID, publishErr)
+		}
+
+		err = o.store.MarkSent(ctx, message.ID)
+		if err != nil {
+			return fmt.Errorf("error marking outbox message %d as sent: %v", message.ID, err)
+		}
+		o.partial = nil
+	}
+	return nil
+}
+
+// recordNack counts the attempt and marks the message as failed once it has been nacked MaxAttempts times.
+// Returns an error to stop the relay if the message will be published again
+func (o *Outbox[DataType, Headers, RoutingKey]) recordNack(ctx context.Context, message OutboxMessage, exchanges []string) error {
+	reason := fmt.Sprintf("nacked by %s", strings.Join(exchanges, ", "))
+	if message.Attempts+1 >= o.options.MaxAttempts {
+		return o.markFailed(ctx, message, fmt.Sprintf("%s after %d attempts", reason, message.Attempts+1))
+	}
+	err := o.store.RecordFailure(ctx, message.ID, reason)
+	if err != nil {
+		return fmt.Errorf("error recording failure of outbox message %d: %v", message.ID, err)
+	}
+	return fmt.Errorf("outbox message %d was %s", message.ID, reason)
+}
+
+func (o *Outbox[DataType, Headers, RoutingKey]) markFailed(ctx context.Context, message OutboxMessage, reason string) error {
+	err := o.store.MarkFailed(ctx, message.ID, reason)
+	if err != nil {
+		return fmt.Errorf("error marking outbox message %d as failed: %v", message.ID, err)
+	}
+	o.partial = nil
+	o.options.Logger.Error("Outbox message failed and will not be relayed",
+		"messageId", message.ID,
+		"reason", reason,
+	)
+	return nil
+}
+
+func describeReturn(result PublishConfirmation) string {
+	if result.Return == nil {
+		return result.Exchange
+	}
+	return fmt.Sprintf("%s (%d %s)", result.Exchange, result.Return.ReplyCode, result.Return.ReplyText)
+}
+
+// MemoryOutboxStore is an OutboxStore that keeps messages in memory.
+// Messages are lost when the process exits so it is mainly useful for testing.
+type MemoryOutboxStore struct {
+	lock     sync.Mutex
+	nextId   int64
+	messages []OutboxMessage
+	failed   []OutboxMessage
+}
+
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{nextId: 1}
+}
+
+func (s *MemoryOutboxStore) Add(_ context.Context, payload []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages = append(s.messages, OutboxMessage{
+		ID:        s.nextId,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	})
+	s.nextId++
+	return nil
+}
+
+func (s *MemoryOutboxStore) Pending(_ context.Context, limit int) ([]OutboxMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if limit > len(s.messages) {
+		limit = len(s.messages)
+	}
+	out := make([]OutboxMessage, limit)
+	copy(out, s.messages[:limit])
+	return out, nil
+}
+
+func (s *MemoryOutboxStore) MarkSent(_ context.Context, id int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, message := range s.messages {
+		if message.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("outbox message not found: %d", id)
+}
+
+func (s *MemoryOutboxStore) RecordFailure(_ context.Context, id int64, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.messages {
+		if s.messages[i].ID == id {
+			s.messages[i].Attempts++
+			s.messages[i].Error = reason
+			return nil
+		}
+	}
+	return fmt.Errorf("outbox message not found: %d", id)
+}
+
+func (s *MemoryOutboxStore) MarkFailed(_ context.Context, id int64, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, message := range s.messages {
+		if message.ID == id {
+			message.Error = reason
+			s.failed = append(s.failed, message)
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("outbox message not found: %d", id)
+}
+
+// Failed returns the messages that were marked as failed
+func (s *MemoryOutboxStore) Failed() []OutboxMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out := make([]OutboxMessage, len(s.failed))
+	copy(out, s.failed)
+	return out
+}
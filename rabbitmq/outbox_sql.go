@@ -0,0 +1,257 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+const defaultOutboxTable = "kapeta_outbox"
+
+const defaultOutboxLeaseDuration = 30 * time.Second
+
+// SQLDialect selects the placeholders and the column types used by SQLOutboxStore
+type SQLDialect string
+
+const (
+	SQLDialectPostgres SQLDialect = "postgres"
+	// SQLDialectMySQL requires parseTime=true in the DSN of the go-sql-driver/mysql driver,
+	// otherwise the timestamps of the messages can not be read
+	SQLDialectMySQL  SQLDialect = "mysql"
+	SQLDialectSQLite SQLDialect = "sqlite"
+)
+
+type SQLOutboxOptions struct {
+	// Table is the name of the outbox table. Defaults to kapeta_outbox.
+	// The relay lease is stored in a table with the suffix _lease
+	Table string
+	// Dialect of the database. Defaults to SQLDialectPostgres
+	Dialect SQLDialect
+	// Placeholder returns the bind parameter for the n'th (1-based) argument.
+	// Defaults to the placeholder style of the dialect
+	Placeholder func(n int) string
+	// LeaseDuration is how long a relay keeps the lease without renewing it.
+	// It must be longer than it takes to relay a batch. Defaults to 30 seconds
+	LeaseDuration time.Duration
+}
+
+// SQLOutboxStore is an OutboxStore backed by a database/sql database.
+// Use AddTx to store messages in the same transaction as your business data.
+// The database driver must scan timestamp columns into time.Time, which for MySQL
+// means adding parseTime=true to the DSN.
+//
+// Every replica of a service can run a relay against the same table. Pending only returns
+// messages to the store holding the relay lease, so the messages are relayed by one
+// replica at a time and in order. If a relay stalls for longer than LeaseDuration another
+// replica takes over, and messages that were not yet marked as sent are published again.
+type SQLOutboxStore struct {
+	db      *sql.DB
+	options SQLOutboxOptions
+	// owner identifies this store in the lease table
+	owner string
+}
+
+func NewSQLOutboxStore(db *sql.DB, options SQLOutboxOptions) *SQLOutboxStore {
+	if options.Table == "" {
+		options.Table = defaultOutboxTable
+	}
+	if options.Dialect == "" {
+		options.Dialect = SQLDialectPostgres
+	}
+	if options.Placeholder == nil {
+		options.Placeholder = func(n int) string {
+			if options.Dialect == SQLDialectPostgres {
+				return fmt.Sprintf("$%d", n)
+			}
+			return "?"
+		}
+	}
+	if options.LeaseDuration <= 0 {
+		options.LeaseDuration = defaultOutboxLeaseDuration
+	}
+	hostname, _ := os.Hostname()
+	return &SQLOutboxStore{
+		db:      db,
+		options: options,
+		owner:   fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+	}
+}
+
+// CreateTable creates the outbox and lease tables if they do not exist
+func (s *SQLOutboxStore) CreateTable(ctx context.Context) error {
+	var idColumn, payloadColumn, timestampColumn string
+	switch s.options.Dialect {
+	case SQLDialectPostgres:
+		idColumn, payloadColumn, timestampColumn = "BIGSERIAL PRIMARY KEY", "TEXT", "TIMESTAMP"
+	case SQLDialectMySQL:
+		idColumn, payloadColumn, timestampColumn = "BIGINT AUTO_INCREMENT PRIMARY KEY", "LONGTEXT", "DATETIME(6)"
+	case SQLDialectSQLite:
+		idColumn, payloadColumn, timestampColumn = "INTEGER PRIMARY KEY AUTOINCREMENT", "TEXT", "TIMESTAMP"
+	default:
+		return fmt.Errorf("unsupported sql dialect: %s", s.options.Dialect)
+	}
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id %s,
+		payload %s NOT NULL,
+		created_at %s NOT NULL,
+		sent_at %s NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		failed_at %s NULL,
+		last_error %s NULL
+	)`, s.options.Table, idColumn, payloadColumn, timestampColumn, timestampColumn, timestampColumn, payloadColumn))
+	if err != nil {
+		return fmt.Errorf("error creating outbox table: %v", err)
+	}
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER PRIMARY KEY,
+		owner VARCHAR(255) NOT NULL,
+		expires_at %s NOT NULL
+	)`, s.leaseTable(), timestampColumn))
+	if err != nil {
+		return fmt.Errorf("error creating outbox lease table: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLOutboxStore) Add(ctx context.Context, payload []byte) error {
+	_, err := s.db.ExecContext(ctx, s.insertQuery(), string(payload), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error adding outbox message: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLOutboxStore) AddTx(ctx context.Context, tx *sql.Tx, payload []byte) error {
+	_, err := tx.ExecContext(ctx, s.insertQuery(), string(payload), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error adding outbox message: %v", err)
+	}
+	return nil
+}
+
+// Pending returns the unsent messages if this store holds the relay lease, and no messages otherwise
+func (s *SQLOutboxStore) Pending(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	held, err := s.acquireLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !held {
+		return []OutboxMessage{}, nil
+	}
+
+	query := fmt.Sprintf(
+		"SELECT id, payload, created_at, attempts, last_error FROM %s WHERE sent_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT %s",
+		s.options.Table, s.options.Placeholder(1),
+	)
+	rows, err := s.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := make([]OutboxMessage, 0)
+	for rows.Next() {
+		var message OutboxMessage
+		var payload string
+		var lastError sql.NullString
+		err = rows.Scan(&message.ID, &payload, &message.CreatedAt, &message.Attempts, &lastError)
+		if err != nil {
+			return nil, fmt.Errorf("error reading outbox message: %v", err)
+		}
+		message.Payload = []byte(payload)
+		message.Error = lastError.String
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (s *SQLOutboxStore) MarkSent(ctx context.Context, id int64) error {
+	query := fmt.Sprintf(
+		"UPDATE %s SET sent_at = %s WHERE id = %s",
+		s.options.Table, s.options.Placeholder(1), s.options.Placeholder(2),
+	)
+	_, err := s.db.ExecContext(ctx, query, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("error marking outbox message as sent: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLOutboxStore) RecordFailure(ctx context.Context, id int64, reason string) error {
+	query := fmt.Sprintf(
+		"UPDATE %s SET attempts = attempts + 1, last_error = %s WHERE id = %s",
+		s.options.Table, s.options.Placeholder(1), s.options.Placeholder(2),
+	)
+	_, err := s.db.ExecContext(ctx, query, reason, id)
+	if err != nil {
+		return fmt.Errorf("error recording outbox message failure: %v", err)
+	}
+	return nil
+}
+
+// MarkFailed keeps the message in the table with failed_at set. Clear failed_at and attempts to relay it again
+func (s *SQLOutboxStore) MarkFailed(ctx context.Context, id int64, reason string) error {
+	query := fmt.Sprintf(
+		"UPDATE %s SET failed_at = %s, last_error = %s WHERE id = %s",
+		s.options.Table, s.options.Placeholder(1), s.options.Placeholder(2), s.options.Placeholder(3),
+	)
+	_, err := s.db.ExecContext(ctx, query, time.Now().UTC(), reason, id)
+	if err != nil {
+		return fmt.Errorf("error marking outbox message as failed: %v", err)
+	}
+	return nil
+}
+
+// acquireLease takes or renews the relay lease. Returns false if another store holds it
+func (s *SQLOutboxStore) acquireLease(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	query := fmt.Sprintf(
+		"UPDATE %s SET owner = %s, expires_at = %s WHERE id = 1 AND (owner = %s OR expires_at < %s)",
+		s.leaseTable(), s.options.Placeholder(1), s.options.Placeholder(2), s.options.Placeholder(3), s.options.Placeholder(4),
+	)
+	result, err := s.db.ExecContext(ctx, query, s.owner, now.Add(s.options.LeaseDuration), s.owner, now)
+	if err != nil {
+		return false, fmt.Errorf("error acquiring outbox lease: %v", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error acquiring outbox lease: %v", err)
+	}
+	if updated > 0 {
+		return true, nil
+	}
+
+	// The lease row is created by the first relay
+	query = fmt.Sprintf(
+		"INSERT INTO %s (id, owner, expires_at) VALUES (1, %s, %s)",
+		s.leaseTable(), s.options.Placeholder(1), s.options.Placeholder(2),
+	)
+	_, insertErr := s.db.ExecContext(ctx, query, s.owner, now.Add(s.options.LeaseDuration))
+	if insertErr == nil {
+		return true, nil
+	}
+	var count int
+	err = s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = 1", s.leaseTable())).Scan(&count)
+	if err != nil || count == 0 {
+		return false, fmt.Errorf("error acquiring outbox lease: %v", insertErr)
+	}
+	// Another relay holds the lease
+	return false, nil
+}
+
+func (s *SQLOutboxStore) leaseTable() string {
+	return s.options.Table + "_lease"
+}
+
+func (s *SQLOutboxStore) insertQuery() string {
+	return fmt.Sprintf(
+		"INSERT INTO %s (payload, created_at) VALUES (%s, %s)",
+		s.options.Table, s.options.Placeholder(1), s.options.Placeholder(2),
+	)
+}
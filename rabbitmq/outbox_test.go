@@ -0,0 +1,173 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+// confirmationError makes the test publisher fail with a publish error
+const confirmationError ConfirmationStatus = "error"
+
+// testOutbox returns an outbox publishing to the exchanges a and b. Each publish to an exchange
+// takes the next status of the exchange from statuses, and is acked when there are none left.
+// The exchanges that were published to are recorded in published.
+func testOutbox(store OutboxStore, statuses map[string][]ConfirmationStatus, published *[]string) *Outbox[map[string]any, map[string]any, string] {
+	publish := func(_ context.Context, _ PublisherPayload[map[string]any, map[string]any, string], skip map[string]bool) ([]PublishConfirmation, error) {
+		results := make([]PublishConfirmation, 0)
+		for _, exchange := range []string{"a", "b"} {
+			if skip[exchange] {
+				continue
+			}
+			*published = append(*published, exchange)
+			status := ConfirmationAcked
+			if len(statuses[exchange]) > 0 {
+				status = statuses[exchange][0]
+				statuses[exchange] = statuses[exchange][1:]
+			}
+			switch status {
+			case confirmationError:
+				return results, fmt.Errorf("connection closed")
+			case ConfirmationReturned:
+				results = append(results, PublishConfirmation{Exchange: exchange, Status: status, Return: &rmq.Return{Return: amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE"}}})
+			default:
+				results = append(results, PublishConfirmation{Exchange: exchange, Status: status})
+			}
+		}
+		return results, nil
+	}
+	return &Outbox[map[string]any, map[string]any, string]{
+		store:   store,
+		publish: publish,
+		options: OutboxOptions{
+			BatchSize:   100,
+			MaxAttempts: 3,
+			Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		},
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		payloads []string
+		statuses map[string][]ConfirmationStatus
+		polls    int
+		// errs is the number of polls that return an error
+		errs      int
+		published []string
+		pending   []OutboxMessage
+		failed    []OutboxMessage
+	}{
+		{
+			name:      "acked",
+			payloads:  []string{`{"routingKey": "one"}`, `{"routingKey": "two"}`},
+			polls:     1,
+			published: []string{"a", "b", "a", "b"},
+		},
+		{
+			name:      "nacked message is only published again to the exchanges that did not ack it",
+			payloads:  []string{`{"routingKey": "one"}`, `{"routingKey": "two"}`},
+			statuses:  map[string][]ConfirmationStatus{"b": {ConfirmationNacked}},
+			polls:     2,
+			errs:      1,
+			published: []string{"a", "b", "b", "a", "b"},
+		},
+		{
+			name:      "nacked message stops the relay",
+			payloads:  []string{`{"routingKey": "one"}`, `{"routingKey": "two"}`},
+			statuses:  map[string][]ConfirmationStatus{"a": {ConfirmationNacked}},
+			polls:     1,
+			errs:      1,
+			published: []string{"a", "b"},
+			pending:   []OutboxMessage{{ID: 1, Attempts: 1, Error: "nacked by a"}, {ID: 2}},
+		},
+		{
+			name:      "nacked until max attempts",
+			payloads:  []string{`{"routingKey": "one"}`, `{"routingKey": "two"}`},
+			statuses:  map[string][]ConfirmationStatus{"b": {ConfirmationNacked, ConfirmationNacked, ConfirmationNacked}},
+			polls:     3,
+			errs:      2,
+			published: []string{"a", "b", "b", "b", "a", "b"},
+			failed:    []OutboxMessage{{ID: 1, Attempts: 2, Error: "nacked by b after 3 attempts"}},
+		},
+		{
+			name:      "returned",
+			payloads:  []string{`{"routingKey": "one"}`, `{"routingKey": "two"}`},
+			statuses:  map[string][]ConfirmationStatus{"a": {ConfirmationReturned}},
+			polls:     1,
+			published: []string{"a", "b", "a", "b"},
+			failed:    []OutboxMessage{{ID: 1, Error: "returned as unroutable by a (312 NO_ROUTE)"}},
+		},
+		{
+			name:      "publish error",
+			payloads:  []string{`{"routingKey": "one"}`},
+			statuses:  map[string][]ConfirmationStatus{"b": {confirmationError}},
+			polls:     2,
+			errs:      1,
+			published: []string{"a", "b", "b"},
+		},
+		{
+			name:      "invalid payload",
+			payloads:  []string{`{"routingKey": "one"`, `{"routingKey": "two"}`},
+			polls:     1,
+			published: []string{"a", "b"},
+			failed:    []OutboxMessage{{ID: 1, Error: "error decoding payload: unexpected end of JSON input"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryOutboxStore()
+			for _, payload := range test.payloads {
+				err := store.Add(ctx, []byte(payload))
+				if err != nil {
+					t.Fatalf("Add() = %v", err)
+				}
+			}
+			published := make([]string, 0)
+			outbox := testOutbox(store, test.statuses, &published)
+
+			errs := 0
+			for i := 0; i < test.polls; i++ {
+				if outbox.relayPending(ctx) != nil {
+					errs++
+				}
+			}
+			if errs != test.errs {
+				t.Errorf("relayPending() failed %d times, want %d", errs, test.errs)
+			}
+			if !reflect.DeepEqual(published, test.published) {
+				t.Errorf("published to %v, want %v", published, test.published)
+			}
+
+			pending, err := store.Pending(ctx, 100)
+			if err != nil {
+				t.Fatalf("Pending() = %v", err)
+			}
+			if !reflect.DeepEqual(outboxState(pending), outboxState(test.pending)) {
+				t.Errorf("pending = %v, want %v", outboxState(pending), outboxState(test.pending))
+			}
+			if !reflect.DeepEqual(outboxState(store.Failed()), outboxState(test.failed)) {
+				t.Errorf("failed = %v, want %v", outboxState(store.Failed()), outboxState(test.failed))
+			}
+		})
+	}
+}
+
+// outboxState leaves out the payload and creation time of the messages
+func outboxState(messages []OutboxMessage) []OutboxMessage {
+	out := make([]OutboxMessage, 0, len(messages))
+	for _, message := range messages {
+		out = append(out, OutboxMessage{ID: message.ID, Attempts: message.Attempts, Error: message.Error})
+	}
+	return out
+}
@@ -0,0 +1,448 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kapetacom/sdk-go-config/providers"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type TopologyAction string
+
+const (
+	// TopologyAdd is declared by the block but does not exist on the broker
+	TopologyAdd TopologyAction = "add"
+	// TopologyConflict exists with different settings. Declaring it fails with PRECONDITION_FAILED
+	TopologyConflict TopologyAction = "conflict"
+	// TopologyOrphan is a binding on the broker that the block no longer declares
+	TopologyOrphan TopologyAction = "orphan"
+)
+
+type TopologyResource string
+
+const (
+	TopologyExchange TopologyResource = "exchange"
+	TopologyQueue    TopologyResource = "queue"
+	TopologyBinding  TopologyResource = "binding"
+)
+
+// TopologyChange is a difference between the block and the broker
+type TopologyChange struct {
+	Action   TopologyAction
+	Resource TopologyResource
+	// Name of the exchange or queue, or a description of the binding
+	Name string
+	// Conflicts lists the settings that differ for TopologyConflict
+	Conflicts []string
+	// Binding is set for binding changes
+	Binding *Binding
+}
+
+func (c TopologyChange) String() string {
+	if len(c.Conflicts) > 0 {
+		return fmt.Sprintf("%s %s %s: %s", c.Action, c.Resource, c.Name, strings.Join(c.Conflicts, "; "))
+	}
+	return fmt.Sprintf("%s %s %s", c.Action, c.Resource, c.Name)
+}
+
+// InstanceTopologyPlan lists the changes in the vhost of one instance
+type InstanceTopologyPlan struct {
+	InstanceId string
+	VHost      string
+	Changes    []TopologyChange
+}
+
+// TopologyPlan is the result of PlanTopology
+type TopologyPlan struct {
+	Instances []InstanceTopologyPlan
+}
+
+// HasChanges returns true if anything would be changed or fail on the broker
+func (p *TopologyPlan) HasChanges() bool {
+	for _, instance := range p.Instances {
+		if len(instance.Changes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasConflicts returns true if declaring the topology would fail
+func (p *TopologyPlan) HasConflicts() bool {
+	for _, instance := range p.Instances {
+		for _, change := range instance.Changes {
+			if change.Action == TopologyConflict {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PlanTopology resolves the exchanges, queues and bindings the publisher or consumer
+// resource would declare and compares them with the current state of the broker.
+// Nothing is changed on the broker.
+func PlanTopology(config providers.ConfigProvider, resourceName string) (*TopologyPlan, error) {
+	ctx := context.Background()
+	targets, err := resolveResourceDeclarations(config, resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &TopologyPlan{}
+	for _, target := range targets {
+		operator, err := config.GetInstanceOperator(target.instanceId)
+		if err != nil {
+			return nil, fmt.Errorf("error getting instance operator: %v", err)
+		}
+		_, tlsConfig, err := operatorTLSConfig(operator, nil)
+		if err != nil {
+			return nil, err
+		}
+		client := NewRabbitRESTClientWithTLS(operator, tlsConfig)
+		vhost := instanceVHost(target.instanceId)
+		changes, err := planDeclarations(ctx, client, vhost, target.declarations)
+		if err != nil {
+			return nil, err
+		}
+		plan.Instances = append(plan.Instances, InstanceTopologyPlan{
+			InstanceId: target.instanceId,
+			VHost:      vhost,
+			Changes:    changes,
+		})
+	}
+	return plan, nil
+}
+
+type instanceDeclarations struct {
+	instanceId   string
+	declarations *declarations
+}
+
+// resolveResourceDeclarations returns the declarations of the publisher or consumer resource per instance
+func resolveResourceDeclarations(config providers.ConfigProvider, resourceName string) ([]instanceDeclarations, error) {
+	_, err := findPublisherResource(config, resourceName)
+	if errors.Is(err, errResourceNotFound) {
+		// Not a publisher so it must be a consumer
+		instance, err := config.GetInstanceForConsumer(resourceName)
+		if err != nil {
+			return nil, err
+		}
+		blockSpec, err := toBlockSpec(instance)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding block spec: %v", err)
+		}
+		queue, err := findConsumerQueue(instance, blockSpec, resourceName)
+		if err != nil {
+			return nil, err
+		}
+		declared, err := resolveQueueDeclarations(blockSpec, queue)
+		if err != nil {
+			return nil, err
+		}
+		return []instanceDeclarations{{instanceId: instance.InstanceId, declarations: declared}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := config.GetInstancesForProvider(resourceName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting instances for provider: %v", err)
+	}
+	out := make([]instanceDeclarations, 0, len(instances))
+	for _, instance := range instances {
+		blockSpec, err := toBlockSpec(instance)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding block spec: %v", err)
+		}
+		exchangeDefinitions, err := findPublisherExchanges(instance, blockSpec, resourceName)
+		if err != nil {
+			return nil, err
+		}
+		merged := &declarations{}
+		for _, exchangeDefinition := range exchangeDefinitions {
+			declared, err := resolveExchangeDeclarations(blockSpec, exchangeDefinition)
+			if err != nil {
+				return nil, err
+			}
+			merged.exchanges = append(merged.exchanges, declared.exchanges...)
+			merged.bindings = append(merged.bindings, declared.bindings...)
+		}
+		out = append(out, instanceDeclarations{instanceId: instance.InstanceId, declarations: merged})
+	}
+	return out, nil
+}
+
+// planDeclarations compares the declarations with the exchanges, queues and bindings in the vhost
+func planDeclarations(ctx context.Context, client *RabbitRESTClient, vhost string, declared *declarations) ([]TopologyChange, error) {
+	var exchanges []Exchange
+	var queues []Queue
+	var bindings []Binding
+	_, err := client.GetVHost(ctx, vhost)
+	if err != nil && !IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get vhost: %s. Error: %v", vhost, err)
+	}
+	if err == nil {
+		// A missing vhost has nothing in it
+		exchanges, err = client.ListExchanges(ctx, vhost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list exchanges in vhost: %s. Error: %v", vhost, err)
+		}
+		queues, err = client.ListQueues(ctx, vhost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list queues in vhost: %s. Error: %v", vhost, err)
+		}
+		bindings, err = client.ListBindings(ctx, vhost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bindings in vhost: %s. Error: %v", vhost, err)
+		}
+	}
+
+	existingExchanges := map[string]Exchange{}
+	for _, exchange := range exchanges {
+		existingExchanges[exchange.Name] = exchange
+	}
+	existingQueues := map[string]Queue{}
+	for _, queue := range queues {
+		existingQueues[queue.Name] = queue
+	}
+
+	changes := make([]TopologyChange, 0)
+	seen := map[string]bool{}
+	for _, exchange := range declared.exchanges {
+		if seen["e:"+exchange.Name] {
+			continue
+		}
+		seen["e:"+exchange.Name] = true
+		existing, ok := existingExchanges[exchange.Name]
+		if !ok {
+			changes = append(changes, TopologyChange{Action: TopologyAdd, Resource: TopologyExchange, Name: exchange.Name})
+			continue
+		}
+		conflicts := exchangeConflicts(exchange, existing)
+		if len(conflicts) > 0 {
+			changes = append(changes, TopologyChange{Action: TopologyConflict, Resource: TopologyExchange, Name: exchange.Name, Conflicts: conflicts})
+		}
+	}
+
+	// Destinations whose bindings are owned by the declarations. Bindings to them
+	// on the broker that are not declared are orphans.
+	owned := map[string]bool{}
+	for _, queue := range declared.queues {
+		if queue.Name == "" {
+			// Exclusive queues are created with a new name by every consumer
+			continue
+		}
+		owned[bindingDestinationKey(BindingDestinationQueue, queue.Name)] = true
+		if seen["q:"+queue.Name] {
+			continue
+		}
+		seen["q:"+queue.Name] = true
+		existing, ok := existingQueues[queue.Name]
+		if !ok {
+			changes = append(changes, TopologyChange{Action: TopologyAdd, Resource: TopologyQueue, Name: queue.Name})
+			continue
+		}
+		conflicts := queueConflicts(queue, existing)
+		if len(conflicts) > 0 {
+			changes = append(changes, TopologyChange{Action: TopologyConflict, Resource: TopologyQueue, Name: queue.Name, Conflicts: conflicts})
+		}
+	}
+
+	expectedBindings := map[string]bool{}
+	for _, binding := range declared.bindings {
+		if binding.DestinationName == "" {
+			continue
+		}
+		expected := asRESTBinding(vhost, binding)
+		owned[bindingDestinationKey(expected.DestinationType, expected.Destination)] = true
+		key := bindingKey(expected)
+		if expectedBindings[key] {
+			continue
+		}
+		expectedBindings[key] = true
+		if !containsBinding(bindings, expected) {
+			changes = append(changes, TopologyChange{
+				Action:   TopologyAdd,
+				Resource: TopologyBinding,
+				Name:     describeBinding(expected),
+				Binding:  &expected,
+			})
+		}
+	}
+
+	for i := range bindings {
+		existing := bindings[i]
+		if existing.Source == "" {
+			// Every queue is bound to the default exchange
+			continue
+		}
+		if !owned[bindingDestinationKey(existing.DestinationType, existing.Destination)] {
+			continue
+		}
+		if expectedBindings[bindingKey(existing)] {
+			continue
+		}
+		changes = append(changes, TopologyChange{
+			Action:   TopologyOrphan,
+			Resource: TopologyBinding,
+			Name:     describeBinding(existing),
+			Binding:  &existing,
+		})
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return topologyResourceOrder(changes[i].Resource) < topologyResourceOrder(changes[j].Resource)
+	})
+	return changes, nil
+}
+
+func topologyResourceOrder(resource TopologyResource) int {
+	switch resource {
+	case TopologyExchange:
+		return 0
+	case TopologyQueue:
+		return 1
+	}
+	return 2
+}
+
+func exchangeConflicts(exchange *rmq.ExchangeOptions, existing Exchange) []string {
+	conflicts := make([]string, 0)
+	if exchange.Kind != existing.Type {
+		conflicts = append(conflicts, fmt.Sprintf("type is %s, declared %s", existing.Type, exchange.Kind))
+	}
+	if exchange.Durable != existing.Durable {
+		conflicts = append(conflicts, fmt.Sprintf("durable is %t, declared %t", existing.Durable, exchange.Durable))
+	}
+	if exchange.AutoDelete != existing.AutoDelete {
+		conflicts = append(conflicts, fmt.Sprintf("auto delete is %t, declared %t", existing.AutoDelete, exchange.AutoDelete))
+	}
+	if exchange.Internal != existing.Internal {
+		conflicts = append(conflicts, fmt.Sprintf("internal is %t, declared %t", existing.Internal, exchange.Internal))
+	}
+	return append(conflicts, argumentConflicts(exchange.Args, existing.Arguments)...)
+}
+
+func queueConflicts(queue *rmq.QueueOptions, existing Queue) []string {
+	conflicts := make([]string, 0)
+	if queue.Durable != existing.Durable {
+		conflicts = append(conflicts, fmt.Sprintf("durable is %t, declared %t", existing.Durable, queue.Durable))
+	}
+	if queue.AutoDelete != existing.AutoDelete {
+		conflicts = append(conflicts, fmt.Sprintf("auto delete is %t, declared %t", existing.AutoDelete, queue.AutoDelete))
+	}
+	if queue.Exclusive != existing.Exclusive {
+		conflicts = append(conflicts, fmt.Sprintf("exclusive is %t, declared %t", existing.Exclusive, queue.Exclusive))
+	}
+	arguments := map[string]any{}
+	for name, value := range existing.Arguments {
+		arguments[name] = value
+	}
+	if _, ok := queue.Args["x-queue-type"]; !ok && arguments["x-queue-type"] == QueueTypeClassic {
+		// Newer brokers add the default queue type to the arguments
+		delete(arguments, "x-queue-type")
+	}
+	return append(conflicts, argumentConflicts(queue.Args, arguments)...)
+}
+
+// argumentConflicts compares declared arguments with the arguments returned by the management API
+func argumentConflicts(declared rmq.Table, existing map[string]any) []string {
+	expected := normalizeJSON(declared)
+	actual := normalizeJSON(existing)
+	names := map[string]bool{}
+	for name := range expected {
+		names[name] = true
+	}
+	for name := range actual {
+		names[name] = true
+	}
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	conflicts := make([]string, 0)
+	for _, name := range sortedNames {
+		expectedValue, expectedOk := expected[name]
+		actualValue, actualOk := actual[name]
+		switch {
+		case !actualOk:
+			conflicts = append(conflicts, fmt.Sprintf("argument %s is not set, declared %v", name, expectedValue))
+		case !expectedOk:
+			conflicts = append(conflicts, fmt.Sprintf("argument %s is %v, not declared", name, actualValue))
+		case !reflect.DeepEqual(expectedValue, actualValue):
+			conflicts = append(conflicts, fmt.Sprintf("argument %s is %v, declared %v", name, actualValue, expectedValue))
+		}
+	}
+	return conflicts
+}
+
+// normalizeJSON round trips the map through JSON so values compare the way the API returns them
+func normalizeJSON[T ~map[string]any](value T) map[string]any {
+	out := map[string]any{}
+	if len(value) == 0 {
+		return out
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return out
+	}
+	_ = json.Unmarshal(encoded, &out)
+	return out
+}
+
+func asRESTBinding(vhost string, binding *rmq.Binding) Binding {
+	destinationType := BindingDestinationQueue
+	if binding.DestinationType == rmq.BindingTypeExchange {
+		destinationType = BindingDestinationExchange
+	}
+	return Binding{
+		Source:          binding.ExchangeName,
+		VHost:           vhost,
+		Destination:     binding.DestinationName,
+		DestinationType: destinationType,
+		RoutingKey:      binding.RoutingKey,
+		Arguments:       normalizeJSON(binding.Args),
+	}
+}
+
+func bindingDestinationKey(destinationType, destination string) string {
+	return destinationType + ":" + destination
+}
+
+func bindingKey(binding Binding) string {
+	arguments, _ := json.Marshal(normalizeJSON(binding.Arguments))
+	return strings.Join([]string{binding.Source, binding.DestinationType, binding.Destination, binding.RoutingKey, string(arguments)}, "\x00")
+}
+
+func containsBinding(bindings []Binding, binding Binding) bool {
+	key := bindingKey(binding)
+	for _, existing := range bindings {
+		if bindingKey(existing) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func describeBinding(binding Binding) string {
+	description := fmt.Sprintf("%s -> %s %s", binding.Source, binding.DestinationType, binding.Destination)
+	if binding.RoutingKey != "" {
+		description += fmt.Sprintf(" (%s)", binding.RoutingKey)
+	}
+	if len(binding.Arguments) > 0 {
+		description += fmt.Sprintf(" %v", binding.Arguments)
+	}
+	return description
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/kapetacom/sdk-go-config/providers"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testManagementServer serves the vhost, exchanges, queues and bindings of a single vhost.
+// The vhost does not exist if exchanges is nil
+func testManagementServer(t *testing.T, vhost string, exchanges []Exchange, queues []Queue, bindings []Binding) *RabbitRESTClient {
+	return testRESTClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if exchanges == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"Object Not Found","reason":"Not Found"}`))
+			return
+		}
+		var body any
+		switch r.URL.EscapedPath() {
+		case "/api/vhosts/" + url.PathEscape(vhost):
+			body = VHost{Name: vhost}
+		case "/api/exchanges/" + url.PathEscape(vhost):
+			body = exchanges
+		case "/api/queues/" + url.PathEscape(vhost):
+			body = queues
+		case "/api/bindings/" + url.PathEscape(vhost):
+			body = bindings
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(body)
+	}))
+}
+
+// testRESTClient returns a client for a management API served by the handler
+func testRESTClient(t *testing.T, handler http.Handler) *RabbitRESTClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("error parsing server url: %v", err)
+	}
+	port, err := strconv.Atoi(serverURL.Port())
+	if err != nil {
+		t.Fatalf("error parsing server port: %v", err)
+	}
+	return NewRabbitRESTClient(&providers.InstanceOperator{
+		Hostname:    serverURL.Hostname(),
+		Ports:       map[string]providers.InstanceOperatorPort{"management": {Port: port}},
+		Credentials: map[string]any{"username": "guest", "password": "guest"},
+	})
+}
+
+func TestPlanDeclarations(t *testing.T) {
+	blockSpec := testBlockSpec([]string{"events"}, "events -> qorders")
+	queue := testQueue("qorders", QueueSpec{Durable: true})
+	blockSpec.Providers = []QueueResource{queue}
+	declared, err := resolveQueueDeclarations(blockSpec, queue)
+	if err != nil {
+		t.Fatalf("resolveQueueDeclarations() = %v", err)
+	}
+
+	events := Exchange{Name: "events", VHost: "test", Type: ExchangeTypeTopic, Arguments: map[string]any{}}
+	orders := Queue{Name: "qorders", VHost: "test", Durable: true, Arguments: map[string]any{"x-queue-type": QueueTypeClassic}}
+	binding := Binding{Source: "events", VHost: "test", Destination: "qorders", DestinationType: BindingDestinationQueue, RoutingKey: "qorders", Arguments: map[string]any{}}
+	defaultBinding := Binding{Source: "", VHost: "test", Destination: "qorders", DestinationType: BindingDestinationQueue, RoutingKey: "qorders", Arguments: map[string]any{}}
+
+	tests := []struct {
+		name      string
+		exchanges []Exchange
+		queues    []Queue
+		bindings  []Binding
+		changes   []string
+	}{
+		{
+			name: "missing vhost",
+			changes: []string{
+				"add exchange events",
+				"add queue qorders",
+				"add binding events -> queue qorders (qorders)",
+			},
+		},
+		{
+			name:      "empty vhost",
+			exchanges: []Exchange{},
+			changes: []string{
+				"add exchange events",
+				"add queue qorders",
+				"add binding events -> queue qorders (qorders)",
+			},
+		},
+		{
+			name:      "up to date",
+			exchanges: []Exchange{events},
+			queues:    []Queue{orders},
+			bindings:  []Binding{defaultBinding, binding},
+		},
+		{
+			name:      "conflicts",
+			exchanges: []Exchange{{Name: "events", VHost: "test", Type: ExchangeTypeDirect, Arguments: map[string]any{"alternate-exchange": "unrouted"}}},
+			queues:    []Queue{{Name: "qorders", VHost: "test", Arguments: map[string]any{"x-max-length": 10}}},
+			bindings:  []Binding{defaultBinding, binding},
+			changes: []string{
+				"conflict exchange events: type is direct, declared topic; argument alternate-exchange is unrouted, not declared",
+				"conflict queue qorders: durable is false, declared true; argument x-max-length is 10, not declared",
+			},
+		},
+		{
+			name:      "orphaned bindings",
+			exchanges: []Exchange{events},
+			queues:    []Queue{orders},
+			bindings: []Binding{
+				defaultBinding,
+				binding,
+				{Source: "events", VHost: "test", Destination: "qorders", DestinationType: BindingDestinationQueue, RoutingKey: "old", Arguments: map[string]any{}},
+				// Bindings to destinations that are not declared by the block are left alone
+				{Source: "events", VHost: "test", Destination: "qother", DestinationType: BindingDestinationQueue, RoutingKey: "other", Arguments: map[string]any{}},
+			},
+			changes: []string{
+				"orphan binding events -> queue qorders (old)",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := testManagementServer(t, "test", test.exchanges, test.queues, test.bindings)
+			changes, err := planDeclarations(context.Background(), client, "test", declared)
+			if err != nil {
+				t.Fatalf("planDeclarations() = %v", err)
+			}
+			descriptions := make([]string, 0, len(changes))
+			for _, change := range changes {
+				descriptions = append(descriptions, change.String())
+			}
+			if len(test.changes) == 0 {
+				test.changes = []string{}
+			}
+			if !reflect.DeepEqual(descriptions, test.changes) {
+				t.Errorf("planDeclarations() =\n%s\nwant\n%s", strings.Join(descriptions, "\n"), strings.Join(test.changes, "\n"))
+			}
+		})
+	}
+}
+
+func TestPlanDeclarationsError(t *testing.T) {
+	client := testRESTClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	_, err := planDeclarations(context.Background(), client, "test", &declarations{})
+	if err == nil || !strings.Contains(err.Error(), "failed to get vhost: test") {
+		t.Fatalf("planDeclarations() error = %v, want failed to get vhost", err)
+	}
+}
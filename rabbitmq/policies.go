@@ -0,0 +1,262 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// policyPrefix marks the policies managed by this SDK. Other policies in the vhost are left alone
+const policyPrefix = "kapeta."
+
+const (
+	policyApplyToQueues    = "queues"
+	policyApplyToExchanges = "exchanges"
+)
+
+type PolicyMode string
+
+const (
+	// PolicyModeApply creates, updates and deletes policies to match the block spec
+	PolicyModeApply PolicyMode = "apply"
+	// PolicyModeReport logs policies that do not match the block spec without changing them
+	PolicyModeReport PolicyMode = "report"
+	// PolicyModeDisabled does not check policies
+	PolicyModeDisabled PolicyMode = "disabled"
+)
+
+// PolicyDrift describes a managed policy that does not match the block spec.
+// Expected is nil if the policy should not exist and Actual is nil if it is missing.
+type PolicyDrift struct {
+	Name     string
+	Expected *PolicySettings
+	Actual   *Policy
+}
+
+func (d PolicyDrift) String() string {
+	switch {
+	case d.Actual == nil:
+		return fmt.Sprintf("policy %s is missing", d.Name)
+	case d.Expected == nil:
+		return fmt.Sprintf("policy %s is not declared", d.Name)
+	}
+	return fmt.Sprintf("policy %s differs: expected %v on %s, found %v on %s",
+		d.Name, d.Expected.Definition, d.Expected.Pattern, d.Actual.Definition, d.Actual.Pattern)
+}
+
+func policyName(applyTo, name string) string {
+	return policyPrefix + applyTo + "." + name
+}
+
+// asPolicy returns the policy settings for the spec.
+// Keys set by the typed fields can not also be set in the definition.
+func asPolicy(applyTo, name string, spec *PolicySpec) (PolicySettings, error) {
+	definition := map[string]any{}
+	for key, value := range spec.Definition {
+		definition[key] = value
+	}
+
+	queueKeys := map[string]any{
+		"message-ttl":      spec.MessageTTL,
+		"expires":          spec.Expires,
+		"max-length":       spec.MaxLength,
+		"max-length-bytes": spec.MaxLengthBytes,
+		"overflow":         spec.Overflow,
+		"delivery-limit":   spec.DeliveryLimit,
+		"ha-mode":          spec.HAMode,
+		"ha-params":        spec.HAParams,
+		"ha-sync-mode":     spec.HASyncMode,
+	}
+	exchangeKeys := map[string]any{
+		"alternate-exchange": spec.AlternateExchange,
+	}
+	for key, value := range queueKeys {
+		if isZeroPolicyValue(value) {
+			continue
+		}
+		if applyTo != policyApplyToQueues {
+			return PolicySettings{}, fmt.Errorf("policy key %s is only supported for queues: %s", key, name)
+		}
+		if _, ok := definition[key]; ok {
+			return PolicySettings{}, fmt.Errorf("policy key %s is also set in the definition: %s", key, name)
+		}
+		definition[key] = value
+	}
+	for key, value := range exchangeKeys {
+		if isZeroPolicyValue(value) {
+			continue
+		}
+		if applyTo != policyApplyToExchanges {
+			return PolicySettings{}, fmt.Errorf("policy key %s is only supported for exchanges: %s", key, name)
+		}
+		if _, ok := definition[key]; ok {
+			return PolicySettings{}, fmt.Errorf("policy key %s is also set in the definition: %s", key, name)
+		}
+		definition[key] = value
+	}
+
+	switch spec.Overflow {
+	case "", "drop-head", "reject-publish", "reject-publish-dlx":
+	default:
+		return PolicySettings{}, fmt.Errorf("invalid overflow %q in policy for: %s", spec.Overflow, name)
+	}
+	if len(definition) == 0 {
+		return PolicySettings{}, fmt.Errorf("empty policy for: %s", name)
+	}
+
+	return PolicySettings{
+		Pattern:    "^" + regexp.QuoteMeta(name) + "$",
+		ApplyTo:    applyTo,
+		Priority:   spec.Priority,
+		Definition: definition,
+	}, nil
+}
+
+func isZeroPolicyValue(value any) bool {
+	return value == nil || reflect.ValueOf(value).IsZero()
+}
+
+// resolvePolicies returns the policies declared in the block spec by policy name
+func resolvePolicies(blockSpec *BlockSpec) (map[string]PolicySettings, error) {
+	policies := map[string]PolicySettings{}
+	if blockSpec == nil {
+		return policies, nil
+	}
+	for _, exchange := range blockSpec.Consumers {
+		if exchange.Spec.Policy == nil {
+			continue
+		}
+		settings, err := asPolicy(policyApplyToExchanges, exchange.Metadata.Name, exchange.Spec.Policy)
+		if err != nil {
+			return nil, err
+		}
+		policies[policyName(policyApplyToExchanges, exchange.Metadata.Name)] = settings
+	}
+	for _, queue := range blockSpec.Providers {
+		if queue.Spec.Policy == nil {
+			continue
+		}
+		if queue.Spec.Exclusive {
+			return nil, fmt.Errorf("policies are not supported for exclusive queue: %s", queue.Metadata.Name)
+		}
+		settings, err := asPolicy(policyApplyToQueues, queue.Metadata.Name, queue.Spec.Policy)
+		if err != nil {
+			return nil, err
+		}
+		policies[policyName(policyApplyToQueues, queue.Metadata.Name)] = settings
+	}
+	return policies, nil
+}
+
+// CheckPolicies compares the managed policies in the vhost with the block spec
+func CheckPolicies(ctx context.Context, client *RabbitRESTClient, vhost string, blockSpec *BlockSpec) ([]PolicyDrift, error) {
+	expected, err := resolvePolicies(blockSpec)
+	if err != nil {
+		return nil, err
+	}
+	current, err := client.ListPolicies(ctx, vhost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies in vhost: %s. Error: %v", vhost, err)
+	}
+
+	actual := map[string]*Policy{}
+	for i, policy := range current {
+		if strings.HasPrefix(policy.Name, policyPrefix) {
+			actual[policy.Name] = &current[i]
+		}
+	}
+
+	drifts := make([]PolicyDrift, 0)
+	for name, settings := range expected {
+		settings := settings
+		policy := actual[name]
+		if policy != nil && policyMatches(settings, policy) {
+			continue
+		}
+		drifts = append(drifts, PolicyDrift{Name: name, Expected: &settings, Actual: policy})
+	}
+	for name, policy := range actual {
+		if _, ok := expected[name]; !ok {
+			drifts = append(drifts, PolicyDrift{Name: name, Actual: policy})
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		return drifts[i].Name < drifts[j].Name
+	})
+	return drifts, nil
+}
+
+// ApplyPolicies creates, updates and deletes the managed policies in the vhost to match the block spec.
+// Policies that already match are not changed. Returns the drifts that were corrected.
+func ApplyPolicies(ctx context.Context, client *RabbitRESTClient, vhost string, blockSpec *BlockSpec) ([]PolicyDrift, error) {
+	drifts, err := CheckPolicies(ctx, client, vhost, blockSpec)
+	if err != nil {
+		return nil, err
+	}
+	for _, drift := range drifts {
+		if drift.Expected == nil {
+			err = client.DeletePolicy(ctx, vhost, drift.Name)
+		} else {
+			err = client.PutPolicy(ctx, vhost, drift.Name, *drift.Expected)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update policy: %s. Error: %v", drift.Name, err)
+		}
+	}
+	return drifts, nil
+}
+
+// ensurePolicies applies or reports the policies depending on the mode
+func ensurePolicies(ctx context.Context, client *RabbitRESTClient, vhost string, blockSpec *BlockSpec, mode PolicyMode, logger *slog.Logger) error {
+	switch mode {
+	case PolicyModeDisabled:
+		return nil
+	case PolicyModeReport:
+		drifts, err := CheckPolicies(ctx, client, vhost, blockSpec)
+		if err != nil {
+			return err
+		}
+		for _, drift := range drifts {
+			logger.Warn("RabbitMQ policy does not match block definition", "policy", drift.Name, "drift", drift.String())
+		}
+		return nil
+	case PolicyModeApply, "":
+		drifts, err := ApplyPolicies(ctx, client, vhost, blockSpec)
+		if err != nil {
+			return err
+		}
+		for _, drift := range drifts {
+			logger.Info("Updated RabbitMQ policy", "policy", drift.Name, "drift", drift.String())
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid policy mode: %s", mode)
+}
+
+// policyMatches compares the settings with a policy returned by the management API
+func policyMatches(settings PolicySettings, policy *Policy) bool {
+	if settings.Pattern != policy.Pattern ||
+		settings.ApplyTo != policy.ApplyTo ||
+		settings.Priority != policy.Priority {
+		return false
+	}
+	// Round trip through JSON so numbers are compared the way the API returns them
+	encoded, err := json.Marshal(settings.Definition)
+	if err != nil {
+		return false
+	}
+	var definition map[string]any
+	err = json.Unmarshal(encoded, &definition)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(definition, policy.Definition)
+}
@@ -0,0 +1,193 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAsPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		applyTo  string
+		spec     PolicySpec
+		settings PolicySettings
+		err      string
+	}{
+		{
+			name:    "queue keys",
+			applyTo: policyApplyToQueues,
+			spec:    PolicySpec{Priority: 2, MessageTTL: 60000, MaxLength: 100, Overflow: "reject-publish"},
+			settings: PolicySettings{
+				Pattern:    `^orders\.v1$`,
+				ApplyTo:    policyApplyToQueues,
+				Priority:   2,
+				Definition: map[string]any{"message-ttl": 60000, "max-length": 100, "overflow": "reject-publish"},
+			},
+		},
+		{
+			name:    "definition",
+			applyTo: policyApplyToQueues,
+			spec:    PolicySpec{DeliveryLimit: 5, Definition: map[string]any{"queue-leader-locator": "balanced"}},
+			settings: PolicySettings{
+				Pattern:    `^orders\.v1$`,
+				ApplyTo:    policyApplyToQueues,
+				Definition: map[string]any{"delivery-limit": 5, "queue-leader-locator": "balanced"},
+			},
+		},
+		{
+			name:    "exchange keys",
+			applyTo: policyApplyToExchanges,
+			spec:    PolicySpec{AlternateExchange: "unrouted"},
+			settings: PolicySettings{
+				Pattern:    `^orders\.v1$`,
+				ApplyTo:    policyApplyToExchanges,
+				Definition: map[string]any{"alternate-exchange": "unrouted"},
+			},
+		},
+		{
+			name:    "queue key on exchange",
+			applyTo: policyApplyToExchanges,
+			spec:    PolicySpec{MessageTTL: 1000},
+			err:     "policy key message-ttl is only supported for queues: orders.v1",
+		},
+		{
+			name:    "exchange key on queue",
+			applyTo: policyApplyToQueues,
+			spec:    PolicySpec{AlternateExchange: "unrouted"},
+			err:     "policy key alternate-exchange is only supported for exchanges: orders.v1",
+		},
+		{
+			name:    "key in both places",
+			applyTo: policyApplyToQueues,
+			spec:    PolicySpec{MaxLength: 100, Definition: map[string]any{"max-length": 200}},
+			err:     "policy key max-length is also set in the definition: orders.v1",
+		},
+		{
+			name:    "invalid overflow",
+			applyTo: policyApplyToQueues,
+			spec:    PolicySpec{Overflow: "drop-tail"},
+			err:     `invalid overflow "drop-tail" in policy for: orders.v1`,
+		},
+		{
+			name:    "empty",
+			applyTo: policyApplyToQueues,
+			spec:    PolicySpec{Priority: 1},
+			err:     "empty policy for: orders.v1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := asPolicy(test.applyTo, "orders.v1", &test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("asPolicy() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("asPolicy() = %v", err)
+			}
+			if !reflect.DeepEqual(settings, test.settings) {
+				t.Errorf("asPolicy() = %+v, want %+v", settings, test.settings)
+			}
+		})
+	}
+}
+
+func TestResolvePolicies(t *testing.T) {
+	blockSpec := testBlockSpec([]string{"events"})
+	blockSpec.Consumers[0].Spec.Policy = &PolicySpec{AlternateExchange: "unrouted"}
+	blockSpec.Providers = []QueueResource{
+		testQueue("orders", QueueSpec{Durable: true, Policy: &PolicySpec{MaxLength: 10}}),
+		testQueue("audit", QueueSpec{Durable: true}),
+	}
+
+	policies, err := resolvePolicies(blockSpec)
+	if err != nil {
+		t.Fatalf("resolvePolicies() = %v", err)
+	}
+	if len(policies) != 2 || policies["kapeta.exchanges.events"].ApplyTo != policyApplyToExchanges || policies["kapeta.queues.orders"].ApplyTo != policyApplyToQueues {
+		t.Errorf("resolvePolicies() = %v", policies)
+	}
+
+	blockSpec.Providers = append(blockSpec.Providers, testQueue("tmp", QueueSpec{Exclusive: true, Policy: &PolicySpec{MaxLength: 10}}))
+	_, err = resolvePolicies(blockSpec)
+	if err == nil || !strings.Contains(err.Error(), "policies are not supported for exclusive queue: tmp") {
+		t.Errorf("resolvePolicies() error = %v, want exclusive queue error", err)
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	settings := PolicySettings{
+		Pattern:    `^orders$`,
+		ApplyTo:    policyApplyToQueues,
+		Priority:   1,
+		Definition: map[string]any{"max-length": 100, "ha-params": []string{"rabbit@a", "rabbit@b"}},
+	}
+	tests := []struct {
+		name    string
+		policy  string
+		matches bool
+	}{
+		{
+			name:    "same",
+			policy:  `{"pattern": "^orders$", "apply-to": "queues", "priority": 1, "definition": {"max-length": 100, "ha-params": ["rabbit@a", "rabbit@b"]}}`,
+			matches: true,
+		},
+		{
+			name:   "different value",
+			policy: `{"pattern": "^orders$", "apply-to": "queues", "priority": 1, "definition": {"max-length": 200, "ha-params": ["rabbit@a", "rabbit@b"]}}`,
+		},
+		{
+			name:   "extra key",
+			policy: `{"pattern": "^orders$", "apply-to": "queues", "priority": 1, "definition": {"max-length": 100, "ha-params": ["rabbit@a", "rabbit@b"], "expires": 1000}}`,
+		},
+		{
+			name:   "different pattern",
+			policy: `{"pattern": "^orders", "apply-to": "queues", "priority": 1, "definition": {"max-length": 100, "ha-params": ["rabbit@a", "rabbit@b"]}}`,
+		},
+		{
+			name:   "different apply-to",
+			policy: `{"pattern": "^orders$", "apply-to": "all", "priority": 1, "definition": {"max-length": 100, "ha-params": ["rabbit@a", "rabbit@b"]}}`,
+		},
+		{
+			name:   "different priority",
+			policy: `{"pattern": "^orders$", "apply-to": "queues", "priority": 0, "definition": {"max-length": 100, "ha-params": ["rabbit@a", "rabbit@b"]}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var policy Policy
+			err := json.Unmarshal([]byte(test.policy), &policy)
+			if err != nil {
+				t.Fatalf("error decoding policy: %v", err)
+			}
+			if matches := policyMatches(settings, &policy); matches != test.matches {
+				t.Errorf("policyMatches() = %v, want %v", matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestPolicyDriftString(t *testing.T) {
+	settings := PolicySettings{Pattern: "^a$", Definition: map[string]any{"max-length": 1}}
+	policy := &Policy{Pattern: "^a$", Definition: map[string]any{"max-length": 2}}
+	tests := []struct {
+		drift PolicyDrift
+		text  string
+	}{
+		{PolicyDrift{Name: "kapeta.queues.a", Expected: &settings}, "policy kapeta.queues.a is missing"},
+		{PolicyDrift{Name: "kapeta.queues.a", Actual: policy}, "policy kapeta.queues.a is not declared"},
+		{PolicyDrift{Name: "kapeta.queues.a", Expected: &settings, Actual: policy}, "policy kapeta.queues.a differs: expected map[max-length:1] on ^a$, found map[max-length:2] on ^a$"},
+	}
+	for _, test := range tests {
+		if text := test.drift.String(); text != test.text {
+			t.Errorf("String() = %q, want %q", text, test.text)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/kapetacom/sdk-go-config/providers"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// exclusiveQueuePattern matches the server generated names of exclusive queues
+const exclusiveQueuePattern = `amq\.gen-.*`
+
+// instanceUser returns the name of the broker user created for the instance.
+// Its permissions are limited to the exchanges and queues of the block spec.
+func instanceUser(instanceId string) string {
+	return "kapeta-" + instanceId
+}
+
+// vhostUser returns the name of the broker user with access to everything in the vhost
+// of the instance. It is separate from the instance user so that connecting without
+// a block spec never widens the permissions of the instance user.
+func vhostUser(instanceId string) string {
+	return "kapeta.vhost-" + instanceId
+}
+
+// instancePassword derives the password of the instance user from the admin password.
+// All processes connecting to the instance compute the same password without sharing state,
+// and it can not be guessed without knowing the admin password.
+func instancePassword(adminPassword, user string) string {
+	mac := hmac.New(sha256.New, []byte(adminPassword))
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// instancePermissions limits the permissions to the exchanges and queues of the block spec.
+// Declaring, binding, publishing and consuming need a mix of configure, write and read
+// on both exchanges and queues so the same pattern is used for all three.
+// A nil block spec grants access to everything in the vhost.
+func instancePermissions(blockSpec *BlockSpec) Permissions {
+	if blockSpec == nil {
+		return Permissions{Configure: ".*", Write: ".*", Read: ".*"}
+	}
+
+	names := map[string]bool{}
+	for _, exchange := range blockSpec.Consumers {
+		names[regexp.QuoteMeta(exchange.Metadata.Name)] = true
+	}
+	for _, queue := range blockSpec.Providers {
+		if queue.Spec.Exclusive {
+			names[exclusiveQueuePattern] = true
+		} else {
+			names[regexp.QuoteMeta(queue.Metadata.Name)] = true
+		}
+		if queue.Spec.DeadLetter != nil {
+			names[regexp.QuoteMeta(deadLetterExchangeName(queue))] = true
+			names[regexp.QuoteMeta(parkingQueueName(queue))] = true
+			for level := range retryDelays(queue.Spec.DeadLetter) {
+				names[regexp.QuoteMeta(retryQueueName(queue, level))] = true
+			}
+		}
+	}
+
+	patterns := make([]string, 0, len(names))
+	for name := range names {
+		patterns = append(patterns, name)
+	}
+	sort.Strings(patterns)
+
+	pattern := "^$"
+	if len(patterns) > 0 {
+		pattern = "^(" + strings.Join(patterns, "|") + ")$"
+	}
+	return Permissions{Configure: pattern, Write: pattern, Read: pattern}
+}
+
+// ensureInstanceUser creates or updates the instance user and its permissions in the vhost.
+// The vhost user is used instead if there is no block spec.
+// Returns the credentials to connect with.
+func ensureInstanceUser(ctx context.Context, client *RabbitRESTClient, instanceId, vhost string, blockSpec *BlockSpec, logger *slog.Logger) (*providers.DefaultCredentials, error) {
+	admin, err := getCredentials(client.operator)
+	if err != nil {
+		return nil, err
+	}
+
+	user := instanceUser(instanceId)
+	if blockSpec == nil {
+		user = vhostUser(instanceId)
+	}
+	logger = logger.With("user", user)
+	credentials := &providers.DefaultCredentials{
+		Username: user,
+		Password: instancePassword(admin.Password, user),
+	}
+
+	// Setting the same password again is harmless so the user is always updated
+	err = client.PutUser(ctx, user, UserSettings{Password: credentials.Password})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %s. Error: %v", user, err)
+	}
+
+	permissions := instancePermissions(blockSpec)
+	current, err := client.GetPermissions(ctx, vhost, user)
+	if err != nil && !IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get permissions of user: %s. Error: %v", user, err)
+	}
+	if err == nil &&
+		current.Configure == permissions.Configure &&
+		current.Write == permissions.Write &&
+		current.Read == permissions.Read {
+		logger.Info("Found RabbitMQ user")
+		return credentials, nil
+	}
+
+	err = client.SetPermissions(ctx, vhost, user, permissions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set permissions of user: %s. Error: %v", user, err)
+	}
+	logger.Info("Updated RabbitMQ user permissions", "pattern", permissions.Configure)
+	return credentials, nil
+}
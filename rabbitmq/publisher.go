@@ -3,10 +3,12 @@
 package rabbitmq
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/kapetacom/sdk-go-config/providers"
 	rmq "github.com/wagslane/go-rabbitmq"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
 	"time"
 )
 
@@ -14,8 +16,8 @@ type PublishOptions struct {
 	// Mandatory fails to publish if there are no queues
 	// bound to the routing key
 	Mandatory bool
-	// Immediate fails to publish if there are no consumers
-	// that can ack bound to the queue on the routing key
+	// Immediate is not supported by RabbitMQ 3.0 and later, which closes the
+	// connection when it is set. Publishing with Immediate returns an error
 	Immediate bool
 	// Transient (0 or 1) or Persistent (2)
 	DeliveryMode uint8
@@ -34,6 +36,9 @@ type PublishOptions struct {
 	Type string
 	// creating user id - ex: "guest"
 	UserID string
+	// Delay holds the message back before it is routed.
+	// Only supported when all exchanges of the publisher are x-delayed-message exchanges
+	Delay time.Duration
 }
 
 type PublisherPayload[DataType any, Headers map[string]any, RoutingKey string] struct {
@@ -45,6 +50,22 @@ type PublisherPayload[DataType any, Headers map[string]any, RoutingKey string] s
 
 type PublisherOptions struct {
 	Confirm bool
+	// ContentType selects the codec used to encode messages. Defaults to application/json
+	ContentType string
+	// DisableValidation skips validating outgoing payloads against the exchange payload types.
+	// Only JSON payloads are validated, since other codecs do not use the field names of the entity
+	DisableValidation bool
+	// RouteValidation controls how routing keys and headers not declared in the
+	// publisher spec are handled. Defaults to RouteValidationLenient
+	RouteValidation RouteValidationMode
+	Tracing         TracingOptions
+	// Metrics records publish counts and durations when set
+	Metrics *Metrics
+	// Logger is used for all log output of the publisher. Defaults to slog.Default()
+	Logger *slog.Logger
+	// Connections shares connections with other publishers and consumers.
+	// Defaults to DefaultConnectionManager()
+	Connections *ConnectionManager
 }
 
 func CreatePublisher[DataType any, Headers map[string]any, RoutingKey string](config providers.ConfigProvider, resourceName string) (*Publisher[DataType, Headers, RoutingKey], error) {
@@ -55,6 +76,35 @@ func CreatePublisherWithOptions[DataType any, Headers map[string]any, RoutingKey
 	config providers.ConfigProvider,
 	resourceName string, publishOptions PublisherOptions) (*Publisher[DataType, Headers, RoutingKey], error) {
 
+	logger := loggerOrDefault(publishOptions.Logger).With(
+		logInstanceId, config.GetInstanceId(),
+		logResourceName, resourceName,
+	)
+
+	if publishOptions.ContentType == "" {
+		publishOptions.ContentType = ContentTypeJSON
+	}
+	codec, err := GetCodec(publishOptions.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if publishOptions.RouteValidation == "" {
+		publishOptions.RouteValidation = RouteValidationLenient
+	}
+	var routes *routeValidator
+	if publishOptions.RouteValidation != RouteValidationDisabled {
+		publisherResource, err := findPublisherResource(config, resourceName)
+		if err != nil {
+			if publishOptions.RouteValidation == RouteValidationStrict {
+				return nil, err
+			}
+			logger.Warn("Routing keys and headers will not be validated", "error", err)
+		} else {
+			routes = newRouteValidator(publisherResource)
+		}
+	}
+
 	instances, err := config.GetInstancesForProvider(resourceName)
 	if err != nil {
 		return nil, fmt.Errorf("error getting instances for provider: %v", err)
@@ -64,8 +114,23 @@ func CreatePublisherWithOptions[DataType any, Headers map[string]any, RoutingKey
 		return nil, fmt.Errorf("no instances found for provider: %s", resourceName)
 	}
 
+	connectionManager := connectionManagerOrDefault(publishOptions.Connections)
 	connections := map[string]*rmq.Conn{}
-	publishers := make([]rmq.Publisher, 0)
+	releases := make([]func() error, 0)
+	publishers := make([]*exchangePublisher, 0)
+
+	created := false
+	defer func() {
+		if created {
+			return
+		}
+		for _, publisher := range publishers {
+			publisher.publisher.Close()
+		}
+		for _, release := range releases {
+			_ = release()
+		}
+	}()
 
 	for _, instance := range instances {
 		blockSpec, err := toBlockSpec(instance)
@@ -74,109 +139,378 @@ func CreatePublisherWithOptions[DataType any, Headers map[string]any, RoutingKey
 		}
 
 		if connections[instance.InstanceId] == nil {
-			conn, err := ConnectToInstance(config, instance.InstanceId)
+			conn, release, err := connectionManager.Acquire(config, instance.InstanceId, blockSpec, logger)
 			if err != nil {
 				return nil, fmt.Errorf("error connecting to instance: %v", err)
 			}
 			connections[instance.InstanceId] = conn
+			releases = append(releases, release)
 		}
 		conn := connections[instance.InstanceId]
 
-		exchangeDefinitions := make([]ExchangeResource, 0)
-
-		for _, connection := range instance.Connections {
-			for _, exchange := range blockSpec.Consumers {
-				if exchange.Metadata.Name == connection.Consumer.ResourceName &&
-					connection.Provider.ResourceName == resourceName {
-					exchangeDefinitions = append(exchangeDefinitions, exchange)
-					break
-				}
-			}
-		}
-
-		if len(exchangeDefinitions) == 0 {
-			return nil, fmt.Errorf("no exchange definitions found for provider %s", resourceName)
+		exchangeDefinitions, err := findPublisherExchanges(instance, blockSpec, resourceName)
+		if err != nil {
+			return nil, err
 		}
 
 		for _, exchangeDefinition := range exchangeDefinitions {
-			exchange := asExchange(&exchangeDefinition)
-
-			bindings, exchanges, err := resolveBindings(blockSpec, rmq.BindingTypeExchange, exchange.Name)
-
+			declared, err := resolveExchangeDeclarations(blockSpec, exchangeDefinition)
 			if err != nil {
-				return nil, fmt.Errorf("error resolving bindings: %v", err)
+				return nil, err
 			}
 
-			exchanges = append(exchanges, &exchange)
-
-			exchangeName := exchange.Name
+			exchangeName := exchangeDefinition.Metadata.Name
+			exchangeLogger := logger.With(logVHost, instance.InstanceId, logExchange, exchangeName)
 
 			publisher, err := rmq.NewPublisher(
 				conn,
-				rmq.WithPublisherOptionsLogging,
+				rmq.WithPublisherOptionsLogger(newRmqLogger(exchangeLogger)),
 				rmq.WithPublisherOptionsConfirmMode(publishOptions.Confirm),
 				rmq.WithPublisherOptionsExchangeName(exchangeName),
-				rmq.WithPublisherExchanges(dereferenceSlice(exchanges)),
-				rmq.WithPublisherBindings(dereferenceSlice(bindings)),
+				rmq.WithPublisherExchanges(dereferenceSlice(declared.exchanges)),
+				rmq.WithPublisherBindings(dereferenceSlice(declared.bindings)),
 			)
 			if err != nil {
 				return nil, fmt.Errorf("error creating publisher: %v", err)
 			}
 
-			publishers = append(publishers, *publisher)
+			exchangePublisher := &exchangePublisher{
+				exchange:  exchangeName,
+				kind:      exchangeDefinition.Spec.ExchangeType,
+				publisher: publisher,
+			}
+			if !publishOptions.DisableValidation && codec.ContentType() == ContentTypeJSON {
+				exchangePublisher.validator = newPayloadValidator(exchangeDefinition.Spec.PayloadType, blockSpec.Entities)
+			}
+			if publishOptions.Confirm {
+				exchangePublisher.returns = newReturnTracker(exchangeLogger)
+				publisher.NotifyReturn(exchangePublisher.returns.handle)
+			}
+
+			publishers = append(publishers, exchangePublisher)
 		}
 	}
 
+	created = true
 	return &Publisher[DataType, Headers, RoutingKey]{
-		appId:      config.GetInstanceId() + "_" + resourceName,
-		publishers: publishers,
+		appId:        config.GetInstanceId() + "_" + resourceName,
+		resourceName: resourceName,
+		metrics:      publishOptions.Metrics,
+		logger:       logger,
+		codec:        codec,
+		confirm:      publishOptions.Confirm,
+		routes:       routes,
+		strict:       publishOptions.RouteValidation == RouteValidationStrict,
+		tracer:       newTracer(publishOptions.Tracing, config.GetInstanceId()),
+		publishers:   publishers,
+		releases:     releases,
 	}, nil
 }
 
+// PublishContextError is returned by PublishWithContext when the context is cancelled
+// or its deadline is exceeded before the message was published to an exchange.
+// The outcome for Exchange is unknown: the publish is not interrupted and the
+// message may still reach the broker after the error has been returned.
+type PublishContextError struct {
+	// Exchange is the name of the exchange that had not finished publishing
+	Exchange string
+	Err      error
+}
+
+func (e *PublishContextError) Error() string {
+	return fmt.Sprintf("publish to exchange %s did not complete: %v", e.Exchange, e.Err)
+}
+
+func (e *PublishContextError) Unwrap() error {
+	return e.Err
+}
+
+// findPublisherExchanges returns the exchanges connected to the publisher resource
+func findPublisherExchanges(instance *providers.BlockInstanceDetails, blockSpec *BlockSpec, resourceName string) ([]ExchangeResource, error) {
+	exchangeDefinitions := make([]ExchangeResource, 0)
+
+	for _, connection := range instance.Connections {
+		for _, exchange := range blockSpec.Consumers {
+			if exchange.Metadata.Name == connection.Consumer.ResourceName &&
+				connection.Provider.ResourceName == resourceName {
+				exchangeDefinitions = append(exchangeDefinitions, exchange)
+				break
+			}
+		}
+	}
+
+	if len(exchangeDefinitions) == 0 {
+		return nil, fmt.Errorf("no exchange definitions found for provider %s", resourceName)
+	}
+	return exchangeDefinitions, nil
+}
+
+type exchangePublisher struct {
+	exchange  string
+	kind      string
+	publisher *rmq.Publisher
+	// returns is only set when the publisher is in confirm mode
+	returns   *returnTracker
+	validator *payloadValidator
+}
+
 type Publisher[DataType any, Headers map[string]any, RoutingKey string] struct {
-	appId      string
-	publishers []rmq.Publisher
+	appId        string
+	resourceName string
+	metrics      *Metrics
+	logger       *slog.Logger
+	codec        Codec
+	confirm      bool
+	routes       *routeValidator
+	strict       bool
+	tracer       *tracer
+	publishers   []*exchangePublisher
+	// releases return the connections to the ConnectionManager
+	releases []func() error
 }
 
 func (p *Publisher[DataType, Headers, RoutingKey]) Publish(payload PublisherPayload[DataType, Headers, RoutingKey]) error {
-	jsonPayload, err := json.Marshal(payload.Data)
+	return p.PublishWithContext(context.Background(), payload)
+}
+
+// PublishWithContext publishes the payload to all exchanges of the publisher.
+// If the context is cancelled or its deadline is exceeded before all exchanges have
+// received the message a *PublishContextError is returned for the first unfinished exchange.
+//
+// The context only stops waiting for the publish, it does not cancel it. A context error
+// means the outcome is unknown and the message may have been published to that exchange.
+// It is not published to the exchanges after it. Use PublishWithConfirmation to know
+// whether the broker received the message.
+func (p *Publisher[DataType, Headers, RoutingKey]) PublishWithContext(ctx context.Context, payload PublisherPayload[DataType, Headers, RoutingKey]) error {
+	err := p.validate(payload)
+	if err != nil {
+		return err
+	}
+	body, err := p.codec.Marshal(payload.Data)
 	if err != nil {
 		return err
 	}
 	routingKey := []string{string(payload.RoutingKey)}
 	for _, publisher := range p.publishers {
-		err := publisher.Publish(
-			jsonPayload,
-			routingKey,
-			rmq.WithPublishOptionsAppID(p.appId),
-			rmq.WithPublishOptionsContentType("application/json"),
-			rmq.WithPublishOptionsContentEncoding("utf-8"),
-			rmq.WithPublishOptionsHeaders(rmq.Table(payload.Headers)),
-			func(options *rmq.PublishOptions) {
-				if payload.Options == nil {
-					return
-				}
-				options.DeliveryMode = payload.Options.DeliveryMode
-				options.Expiration = payload.Options.Expiration
-				options.Priority = payload.Options.Priority
-				options.CorrelationID = payload.Options.CorrelationID
-				options.MessageID = payload.Options.MessageID
-				options.Timestamp = payload.Options.Timestamp
-				options.Type = payload.Options.Type
-				options.UserID = payload.Options.UserID
-			},
-		)
+		if ctx.Err() != nil {
+			return &PublishContextError{Exchange: publisher.exchange, Err: ctx.Err()}
+		}
+
+		started := time.Now()
+		headers := copyHeaders(payload.Headers)
+		spanCtx, span := p.tracer.startPublish(ctx, publisher.exchange, string(payload.RoutingKey), headers)
+		options := p.publishOptions(payload, headers)
+		err := runWithContext(ctx, publisher.exchange, func() error {
+			return publisher.publisher.PublishWithContext(spanCtx, body, routingKey, options...)
+		})
+		endSpan(span, err)
 		if err != nil {
+			p.metrics.observePublish(p.resourceName, publisher.exchange, "error", started)
 			return err
 		}
+		p.metrics.observePublish(p.resourceName, publisher.exchange, "success", started)
 	}
 
 	return nil
 }
 
-func (p *Publisher[DataType, Headers, RoutingKey]) Close() error {
+// PublishWithConfirmation publishes the payload to all exchanges of the publisher and waits
+// for the broker to confirm the message on each of them.
+// The message is published as mandatory so that unroutable messages can be reported as returned,
+// except for x-delayed-message exchanges which only route the message after the delay.
+// PublishOptions.Mandatory is ignored for those exchanges.
+// The publisher must have been created with PublisherOptions.Confirm enabled.
+//
+// ConfirmationReturned is best effort: the underlying client delivers returns asynchronously,
+// so a return can arrive after the ack and the message is then reported as ConfirmationAcked.
+// Late returns are logged. ConfirmationAcked means the broker took responsibility for the
+// message, not that it was routed to a queue. Configure an alternate exchange on the
+// exchange to keep unroutable messages.
+func (p *Publisher[DataType, Headers, RoutingKey]) PublishWithConfirmation(ctx context.Context, payload PublisherPayload[DataType, Headers, RoutingKey]) ([]PublishConfirmation, error) {
+	return p.publishWithConfirmation(ctx, payload, nil)
+}
+
+// publishWithConfirmation publishes to the exchanges that are not in skip
+func (p *Publisher[DataType, Headers, RoutingKey]) publishWithConfirmation(ctx context.Context, payload PublisherPayload[DataType, Headers, RoutingKey], skip map[string]bool) ([]PublishConfirmation, error) {
+	if !p.confirm {
+		return nil, fmt.Errorf("publisher is not in confirm mode")
+	}
+	err := p.validate(payload)
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.codec.Marshal(payload.Data)
+	if err != nil {
+		return nil, err
+	}
+	routingKey := []string{string(payload.RoutingKey)}
+	results := make([]PublishConfirmation, 0, len(p.publishers))
+	for _, publisher := range p.publishers {
+		if skip[publisher.exchange] {
+			continue
+		}
+		confirmId, err := newConfirmId()
+		if err != nil {
+			return results, err
+		}
+
+		started := time.Now()
+		headers := copyHeaders(payload.Headers)
+		headers[confirmIdHeader] = confirmId
+		spanCtx, span := p.tracer.startPublish(ctx, publisher.exchange, string(payload.RoutingKey), headers)
+
+		options := p.publishOptions(payload, headers)
+		if publisher.kind == ExchangeTypeDelayedMessage {
+			// Delayed exchanges route the message later and always return mandatory messages
+			options = append(options, func(options *rmq.PublishOptions) {
+				options.Mandatory = false
+			})
+		} else {
+			options = append(options, rmq.WithPublishOptionsMandatory)
+		}
+
+		publisher.returns.track(confirmId)
+		var confirmations rmq.PublisherConfirmation
+		err = runWithContext(ctx, publisher.exchange, func() error {
+			var err error
+			confirmations, err = publisher.publisher.PublishWithDeferredConfirmWithContext(spanCtx, body, routingKey, options...)
+			return err
+		})
+		if err != nil {
+			publisher.returns.done(confirmId, "")
+			endSpan(span, err)
+			p.metrics.observePublish(p.resourceName, publisher.exchange, "error", started)
+			return results, err
+		}
+
+		result := PublishConfirmation{
+			Exchange: publisher.exchange,
+			Status:   ConfirmationAcked,
+		}
+		for _, confirmation := range confirmations {
+			acked, err := confirmation.WaitContext(ctx)
+			if err != nil {
+				publisher.returns.done(confirmId, "")
+				err = &PublishContextError{Exchange: publisher.exchange, Err: err}
+				endSpan(span, err)
+				p.metrics.observePublish(p.resourceName, publisher.exchange, "error", started)
+				return results, err
+			}
+			if !acked {
+				result.Status = ConfirmationNacked
+			}
+		}
+
+		// Only returns that were handled before the ack was observed are reported
+		returned := publisher.returns.done(confirmId, result.Status)
+		if returned != nil && result.Status == ConfirmationAcked {
+			result.Status = ConfirmationReturned
+			result.Return = returned
+		}
+		span.SetAttributes(attribute.String("kapeta.confirmation", string(result.Status)))
+		endSpan(span, nil)
+		p.metrics.observePublish(p.resourceName, publisher.exchange, string(result.Status), started)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// validate checks the routing and the payload against all exchanges before anything is published
+func (p *Publisher[DataType, Headers, RoutingKey]) validate(payload PublisherPayload[DataType, Headers, RoutingKey]) error {
+	if p.routes != nil {
+		err := p.routes.validate(string(payload.RoutingKey), payload.Headers)
+		if err != nil {
+			if p.strict {
+				return err
+			}
+			p.logger.Warn("Publishing with undeclared routing", "error", err)
+		}
+	}
+	if payload.Options != nil && payload.Options.Immediate {
+		// The connection is shared, so the broker closing it would affect every publisher and consumer
+		return fmt.Errorf("immediate publishing is not supported by RabbitMQ")
+	}
 	for _, publisher := range p.publishers {
-		publisher.Close()
+		if payload.Options != nil && payload.Options.Delay > 0 && publisher.kind != ExchangeTypeDelayedMessage {
+			return fmt.Errorf("exchange %s: delay is only supported for %s exchanges", publisher.exchange, ExchangeTypeDelayedMessage)
+		}
+		if publisher.validator == nil {
+			continue
+		}
+		err := publisher.validator.validate(payload.Data)
+		if err != nil {
+			return fmt.Errorf("exchange %s: %w", publisher.exchange, err)
+		}
 	}
 	return nil
 }
+
+// runWithContext runs the publish function in a separate goroutine since the
+// underlying publisher may block while reconnecting. The publish keeps running
+// after the context is done since the underlying client can not cancel it.
+func runWithContext(ctx context.Context, exchange string, publish func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- publish()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return &PublishContextError{Exchange: exchange, Err: ctx.Err()}
+	}
+}
+
+func copyHeaders(headers map[string]any) rmq.Table {
+	out := rmq.Table{}
+	for key, value := range headers {
+		out[key] = value
+	}
+	return out
+}
+
+func (p *Publisher[DataType, Headers, RoutingKey]) publishOptions(payload PublisherPayload[DataType, Headers, RoutingKey], headers rmq.Table) []func(*rmq.PublishOptions) {
+	contentEncoding := ""
+	if p.codec.ContentType() == ContentTypeJSON {
+		contentEncoding = "utf-8"
+	}
+	if payload.Options != nil && payload.Options.Delay > 0 {
+		headers[delayHeader] = payload.Options.Delay.Milliseconds()
+	}
+	return []func(*rmq.PublishOptions){
+		rmq.WithPublishOptionsAppID(p.appId),
+		rmq.WithPublishOptionsContentType(p.codec.ContentType()),
+		rmq.WithPublishOptionsContentEncoding(contentEncoding),
+		rmq.WithPublishOptionsHeaders(headers),
+		func(options *rmq.PublishOptions) {
+			if payload.Options == nil {
+				return
+			}
+			options.Mandatory = payload.Options.Mandatory
+			options.DeliveryMode = payload.Options.DeliveryMode
+			options.Expiration = payload.Options.Expiration
+			options.Priority = payload.Options.Priority
+			options.CorrelationID = payload.Options.CorrelationID
+			options.MessageID = payload.Options.MessageID
+			options.Timestamp = payload.Options.Timestamp
+			options.Type = payload.Options.Type
+			options.UserID = payload.Options.UserID
+		},
+	}
+}
+
+func (p *Publisher[DataType, Headers, RoutingKey]) Close() error {
+	for _, publisher := range p.publishers {
+		publisher.publisher.Close()
+	}
+	var err error
+	for _, release := range p.releases {
+		releaseErr := release()
+		if releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
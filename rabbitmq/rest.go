@@ -4,10 +4,15 @@
 package rabbitmq
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/kapetacom/sdk-go-config/providers"
+	"io"
 	"net/http"
 	"net/url"
 )
@@ -19,61 +24,423 @@ type RabbitRESTClient struct {
 }
 
 func NewRabbitRESTClient(operator *providers.InstanceOperator) *RabbitRESTClient {
+	return NewRabbitRESTClientWithTLS(operator, nil)
+}
+
+// NewRabbitRESTClientWithTLS creates a client for the management API.
+// HTTPS is used if tlsConfig is set or the management port protocol is https.
+func NewRabbitRESTClientWithTLS(operator *providers.InstanceOperator, tlsConfig *tls.Config) *RabbitRESTClient {
+	managementPort := operator.Ports["management"]
+	scheme := "http"
 	port := 15672
-	if p, ok := operator.Ports["management"]; ok && p.Port != 0 {
-		port = p.Port
+	if tlsConfig != nil || managementPort.Protocol == "https" {
+		scheme = "https"
+		port = 15671
+	}
+	if managementPort.Port != 0 {
+		port = managementPort.Port
 	}
 
 	client := retryablehttp.NewClient()
 	client.RetryMax = 100
+	if tlsConfig != nil {
+		if transport, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+			transport.TLSClientConfig = tlsConfig
+		}
+	}
 	return &RabbitRESTClient{
 		client:   client,
 		operator: operator,
-		baseURL:  fmt.Sprintf("http://%s:%d/api", operator.Hostname, port),
+		baseURL:  fmt.Sprintf("%s://%s:%d/api", scheme, operator.Hostname, port),
 	}
 }
 
-func (c *RabbitRESTClient) GetQueues(vhostName string) (*http.Response, error) {
-	requestUrl := fmt.Sprintf("%s/queues/%s", c.baseURL, url.PathEscape(vhostName))
-	return c.doRequest("GET", requestUrl)
+// APIError is returned when the management API responds with an error status
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Reason     string
+}
+
+func (e *APIError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("%s %s failed: %s: %s", e.Method, e.URL, e.Status, e.Reason)
+	}
+	return fmt.Sprintf("%s %s failed: %s", e.Method, e.URL, e.Status)
+}
+
+// IsNotFound returns true if the error is a 404 from the management API
+func IsNotFound(err error) bool {
+	var apiError *APIError
+	return errors.As(err, &apiError) && apiError.StatusCode == http.StatusNotFound
 }
 
+// vhost
+
+func (c *RabbitRESTClient) ListVHosts(ctx context.Context) ([]VHost, error) {
+	var out []VHost
+	return out, c.do(ctx, http.MethodGet, c.path("vhosts"), nil, &out)
+}
+
+func (c *RabbitRESTClient) GetVHost(ctx context.Context, vhost string) (*VHost, error) {
+	out := &VHost{}
+	return out, c.do(ctx, http.MethodGet, c.path("vhosts", vhost), nil, out)
+}
+
+func (c *RabbitRESTClient) PutVHost(ctx context.Context, vhost string, settings VHostSettings) error {
+	return c.do(ctx, http.MethodPut, c.path("vhosts", vhost), settings, nil)
+}
+
+// CreateVHost creates the vhost. The body of the returned response is closed
+// and error statuses are not returned as errors.
+//
+// Deprecated: Use PutVHost.
 func (c *RabbitRESTClient) CreateVHost(vhostName string) (*http.Response, error) {
-	requestUrl := fmt.Sprintf("%s/vhosts/%s", c.baseURL, url.PathEscape(vhostName))
-	return c.doRequest("PUT", requestUrl)
+	return c.doResponse(http.MethodPut, c.path("vhosts", vhostName), VHostSettings{})
 }
 
-func (c *RabbitRESTClient) doRequest(method, url string) (*http.Response, error) {
-	req, err := c.createRequest(method, url)
+func (c *RabbitRESTClient) DeleteVHost(ctx context.Context, vhost string) error {
+	return c.do(ctx, http.MethodDelete, c.path("vhosts", vhost), nil, nil)
+}
 
+// users
+
+func (c *RabbitRESTClient) ListUsers(ctx context.Context) ([]User, error) {
+	var out []User
+	return out, c.do(ctx, http.MethodGet, c.path("users"), nil, &out)
+}
+
+func (c *RabbitRESTClient) GetUser(ctx context.Context, name string) (*User, error) {
+	out := &User{}
+	return out, c.do(ctx, http.MethodGet, c.path("users", name), nil, out)
+}
+
+func (c *RabbitRESTClient) PutUser(ctx context.Context, name string, settings UserSettings) error {
+	return c.do(ctx, http.MethodPut, c.path("users", name), settings, nil)
+}
+
+func (c *RabbitRESTClient) DeleteUser(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, c.path("users", name), nil, nil)
+}
+
+// permissions
+
+func (c *RabbitRESTClient) ListPermissions(ctx context.Context) ([]Permissions, error) {
+	var out []Permissions
+	return out, c.do(ctx, http.MethodGet, c.path("permissions"), nil, &out)
+}
+
+func (c *RabbitRESTClient) ListVHostPermissions(ctx context.Context, vhost string) ([]Permissions, error) {
+	var out []Permissions
+	return out, c.do(ctx, http.MethodGet, c.path("vhosts", vhost, "permissions"), nil, &out)
+}
+
+func (c *RabbitRESTClient) GetPermissions(ctx context.Context, vhost, user string) (*Permissions, error) {
+	out := &Permissions{}
+	return out, c.do(ctx, http.MethodGet, c.path("permissions", vhost, user), nil, out)
+}
+
+func (c *RabbitRESTClient) SetPermissions(ctx context.Context, vhost, user string, permissions Permissions) error {
+	permissions.User = ""
+	permissions.VHost = ""
+	return c.do(ctx, http.MethodPut, c.path("permissions", vhost, user), permissions, nil)
+}
+
+func (c *RabbitRESTClient) ClearPermissions(ctx context.Context, vhost, user string) error {
+	return c.do(ctx, http.MethodDelete, c.path("permissions", vhost, user), nil, nil)
+}
+
+// exchanges
+
+// ListExchanges lists the exchanges of the vhost, or of all vhosts if vhost is empty
+func (c *RabbitRESTClient) ListExchanges(ctx context.Context, vhost string) ([]Exchange, error) {
+	var out []Exchange
+	return out, c.do(ctx, http.MethodGet, c.optionalVHostPath("exchanges", vhost), nil, &out)
+}
+
+func (c *RabbitRESTClient) GetExchange(ctx context.Context, vhost, name string) (*Exchange, error) {
+	out := &Exchange{}
+	return out, c.do(ctx, http.MethodGet, c.path("exchanges", vhost, name), nil, out)
+}
+
+func (c *RabbitRESTClient) DeclareExchange(ctx context.Context, vhost, name string, settings ExchangeSettings) error {
+	return c.do(ctx, http.MethodPut, c.path("exchanges", vhost, name), settings, nil)
+}
+
+func (c *RabbitRESTClient) DeleteExchange(ctx context.Context, vhost, name string) error {
+	return c.do(ctx, http.MethodDelete, c.path("exchanges", vhost, name), nil, nil)
+}
+
+// queues
+
+// ListQueues lists the queues of the vhost, or of all vhosts if vhost is empty
+func (c *RabbitRESTClient) ListQueues(ctx context.Context, vhost string) ([]Queue, error) {
+	var out []Queue
+	return out, c.do(ctx, http.MethodGet, c.optionalVHostPath("queues", vhost), nil, &out)
+}
+
+// GetQueues requests the queues of the vhost. The body of the returned response is closed
+// and error statuses are not returned as errors.
+//
+// Deprecated: Use ListQueues.
+func (c *RabbitRESTClient) GetQueues(vhostName string) (*http.Response, error) {
+	return c.doResponse(http.MethodGet, c.path("queues", vhostName), nil)
+}
+
+func (c *RabbitRESTClient) GetQueue(ctx context.Context, vhost, name string) (*Queue, error) {
+	out := &Queue{}
+	return out, c.do(ctx, http.MethodGet, c.path("queues", vhost, name), nil, out)
+}
+
+func (c *RabbitRESTClient) DeclareQueue(ctx context.Context, vhost, name string, settings QueueSettings) error {
+	return c.do(ctx, http.MethodPut, c.path("queues", vhost, name), settings, nil)
+}
+
+func (c *RabbitRESTClient) DeleteQueue(ctx context.Context, vhost, name string) error {
+	return c.do(ctx, http.MethodDelete, c.path("queues", vhost, name), nil, nil)
+}
+
+func (c *RabbitRESTClient) PurgeQueue(ctx context.Context, vhost, name string) error {
+	return c.do(ctx, http.MethodDelete, c.path("queues", vhost, name, "contents"), nil, nil)
+}
+
+// bindings
+
+// ListBindings lists the bindings of the vhost, or of all vhosts if vhost is empty
+func (c *RabbitRESTClient) ListBindings(ctx context.Context, vhost string) ([]Binding, error) {
+	var out []Binding
+	return out, c.do(ctx, http.MethodGet, c.optionalVHostPath("bindings", vhost), nil, &out)
+}
+
+func (c *RabbitRESTClient) ListQueueBindings(ctx context.Context, vhost, queue string) ([]Binding, error) {
+	var out []Binding
+	return out, c.do(ctx, http.MethodGet, c.path("queues", vhost, queue, "bindings"), nil, &out)
+}
+
+// CreateBinding binds binding.Source to binding.Destination in the vhost
+func (c *RabbitRESTClient) CreateBinding(ctx context.Context, vhost string, binding Binding) error {
+	body := map[string]any{
+		"routing_key": binding.RoutingKey,
+		"arguments":   binding.Arguments,
+	}
+	requestPath, err := c.bindingPath(vhost, binding)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, requestPath, body, nil)
+}
+
+// DeleteBinding deletes a binding returned by ListBindings, identified by its PropertiesKey
+func (c *RabbitRESTClient) DeleteBinding(ctx context.Context, vhost string, binding Binding) error {
+	if binding.PropertiesKey == "" {
+		return fmt.Errorf("binding from %s to %s has no properties key", binding.Source, binding.Destination)
+	}
+	requestPath, err := c.bindingPath(vhost, binding)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodDelete, requestPath+"/"+url.PathEscape(binding.PropertiesKey), nil, nil)
+}
+
+func (c *RabbitRESTClient) bindingPath(vhost string, binding Binding) (string, error) {
+	switch binding.DestinationType {
+	case BindingDestinationQueue:
+		return c.path("bindings", vhost, "e", binding.Source, "q", binding.Destination), nil
+	case BindingDestinationExchange:
+		return c.path("bindings", vhost, "e", binding.Source, "e", binding.Destination), nil
+	}
+	return "", fmt.Errorf("invalid binding destination type: %q", binding.DestinationType)
+}
+
+// policies
+
+// ListPolicies lists the policies of the vhost, or of all vhosts if vhost is empty
+func (c *RabbitRESTClient) ListPolicies(ctx context.Context, vhost string) ([]Policy, error) {
+	var out []Policy
+	return out, c.do(ctx, http.MethodGet, c.optionalVHostPath("policies", vhost), nil, &out)
+}
+
+func (c *RabbitRESTClient) GetPolicy(ctx context.Context, vhost, name string) (*Policy, error) {
+	out := &Policy{}
+	return out, c.do(ctx, http.MethodGet, c.path("policies", vhost, name), nil, out)
+}
+
+func (c *RabbitRESTClient) PutPolicy(ctx context.Context, vhost, name string, settings PolicySettings) error {
+	return c.do(ctx, http.MethodPut, c.path("policies", vhost, name), settings, nil)
+}
+
+func (c *RabbitRESTClient) DeletePolicy(ctx context.Context, vhost, name string) error {
+	return c.do(ctx, http.MethodDelete, c.path("policies", vhost, name), nil, nil)
+}
+
+// connections
+
+// ListConnections lists the connections of the vhost, or of all vhosts if vhost is empty
+func (c *RabbitRESTClient) ListConnections(ctx context.Context, vhost string) ([]Connection, error) {
+	var out []Connection
+	requestPath := c.path("connections")
+	if vhost != "" {
+		requestPath = c.path("vhosts", vhost, "connections")
+	}
+	return out, c.do(ctx, http.MethodGet, requestPath, nil, &out)
+}
+
+func (c *RabbitRESTClient) GetConnection(ctx context.Context, name string) (*Connection, error) {
+	out := &Connection{}
+	return out, c.do(ctx, http.MethodGet, c.path("connections", name), nil, out)
+}
+
+// CloseConnection force closes the connection. The reason is sent to the client
+func (c *RabbitRESTClient) CloseConnection(ctx context.Context, name, reason string) error {
+	req, err := c.createRequest(ctx, http.MethodDelete, c.path("connections", name), nil)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		req.Header.Set("X-Reason", reason)
+	}
+	_, err = c.send(req, nil)
+	return err
+}
+
+// channels
+
+// ListChannels lists the channels of the vhost, or of all vhosts if vhost is empty
+func (c *RabbitRESTClient) ListChannels(ctx context.Context, vhost string) ([]Channel, error) {
+	var out []Channel
+	requestPath := c.path("channels")
+	if vhost != "" {
+		requestPath = c.path("vhosts", vhost, "channels")
+	}
+	return out, c.do(ctx, http.MethodGet, requestPath, nil, &out)
+}
+
+func (c *RabbitRESTClient) ListConnectionChannels(ctx context.Context, connection string) ([]Channel, error) {
+	var out []Channel
+	return out, c.do(ctx, http.MethodGet, c.path("connections", connection, "channels"), nil, &out)
+}
+
+func (c *RabbitRESTClient) GetChannel(ctx context.Context, name string) (*Channel, error) {
+	out := &Channel{}
+	return out, c.do(ctx, http.MethodGet, c.path("channels", name), nil, out)
+}
+
+// path joins the escaped segments to the base URL
+func (c *RabbitRESTClient) path(segments ...string) string {
+	requestPath := c.baseURL
+	for _, segment := range segments {
+		requestPath += "/" + url.PathEscape(segment)
+	}
+	return requestPath
+}
+
+func (c *RabbitRESTClient) optionalVHostPath(resource, vhost string) string {
+	if vhost == "" {
+		return c.path(resource)
+	}
+	return c.path(resource, vhost)
+}
+
+// do sends the request and decodes the JSON response into out if not nil
+func (c *RabbitRESTClient) do(ctx context.Context, method, requestUrl string, body any, out any) error {
+	req, err := c.createRequest(ctx, method, requestUrl, body)
+	if err != nil {
+		return err
+	}
+	_, err = c.send(req, out)
+	return err
+}
+
+// doResponse sends the request the way the deprecated untyped methods did
+func (c *RabbitRESTClient) doResponse(method, requestUrl string, body any) (*http.Response, error) {
+	req, err := c.createRequest(context.Background(), method, requestUrl, body)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := c.send(req, nil)
+	var apiError *APIError
+	if errors.As(err, &apiError) {
+		return resp, nil
+	}
+	return resp, err
+}
+
+// send returns the response with its body read and closed
+func (c *RabbitRESTClient) send(req *retryablehttp.Request, out any) (*http.Response, error) {
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp, fmt.Errorf("error reading response of %s %s: %v", req.Method, req.URL, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiError := &APIError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+		var errorBody struct {
+			Reason string `json:"reason"`
+		}
+		if json.Unmarshal(responseBody, &errorBody) == nil {
+			apiError.Reason = errorBody.Reason
+		}
+		return resp, apiError
+	}
+
+	if out == nil || len(responseBody) == 0 {
+		return resp, nil
+	}
+	err = json.Unmarshal(responseBody, out)
+	if err != nil {
+		return resp, fmt.Errorf("error decoding response of %s %s: %v", req.Method, req.URL, err)
+	}
 	return resp, nil
 }
 
-func (c *RabbitRESTClient) createHeaders() *http.Header {
-	credential := getCredentials(c.operator)
+func (c *RabbitRESTClient) createHeaders() (*http.Header, error) {
+	credential, err := getCredentials(c.operator)
+	if err != nil {
+		return nil, err
+	}
 
 	auth := base64.StdEncoding.EncodeToString([]byte(credential.Username + ":" + credential.Password))
 	return &http.Header{
-		"Authorization":      []string{"Basic " + auth},
-		"Content-SourceType": []string{"application/json"},
-	}
+		"Authorization": []string{"Basic " + auth},
+		"Content-Type":  []string{"application/json"},
+		"Accept":        []string{"application/json"},
+	}, nil
 }
 
-func (c *RabbitRESTClient) createRequest(method, url string) (*retryablehttp.Request, error) {
-	req, err := retryablehttp.NewRequest(method, url, nil)
+func (c *RabbitRESTClient) createRequest(ctx context.Context, method, url string, body any) (*retryablehttp.Request, error) {
+	var rawBody []byte
+	if body != nil {
+		var err error
+		rawBody, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding request body: %v", err)
+		}
+	}
+	var requestBody any
+	if rawBody != nil {
+		requestBody = rawBody
+	}
+	req, err := retryablehttp.NewRequestWithContext(ctx, method, url, requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	headers, err := c.createHeaders()
 	if err != nil {
-		return nil, fmt.Errorf("error checking vhost: %v", err)
+		return nil, err
 	}
-	headers := c.createHeaders()
 	for k, v := range *headers {
 		req.Header[k] = v
 	}
@@ -0,0 +1,183 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Models of the RabbitMQ management API.
+// See https://www.rabbitmq.com/docs/http-api-reference
+// Only the commonly used fields are mapped.
+
+type VHost struct {
+	Name             string   `json:"name"`
+	Description      string   `json:"description,omitempty"`
+	Tags             UserTags `json:"tags,omitempty"`
+	DefaultQueueType string   `json:"default_queue_type,omitempty"`
+	Tracing          bool     `json:"tracing"`
+}
+
+type VHostSettings struct {
+	Description      string `json:"description,omitempty"`
+	Tags             string `json:"tags,omitempty"`
+	DefaultQueueType string `json:"default_queue_type,omitempty"`
+	Tracing          bool   `json:"tracing,omitempty"`
+}
+
+// UserTags are returned as a list by newer brokers and as a comma separated string by older ones
+type UserTags []string
+
+func (t *UserTags) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*t = list
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*t = nil
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+type User struct {
+	Name             string   `json:"name"`
+	PasswordHash     string   `json:"password_hash,omitempty"`
+	HashingAlgorithm string   `json:"hashing_algorithm,omitempty"`
+	Tags             UserTags `json:"tags"`
+}
+
+// UserSettings creates or updates a user. Set either Password or PasswordHash
+type UserSettings struct {
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Tags is a comma separated list, e.g. "management,monitoring"
+	Tags string `json:"tags"`
+}
+
+type Permissions struct {
+	User      string `json:"user,omitempty"`
+	VHost     string `json:"vhost,omitempty"`
+	Configure string `json:"configure"`
+	Write     string `json:"write"`
+	Read      string `json:"read"`
+}
+
+type Exchange struct {
+	Name       string         `json:"name"`
+	VHost      string         `json:"vhost"`
+	Type       string         `json:"type"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Internal   bool           `json:"internal"`
+	Arguments  map[string]any `json:"arguments"`
+}
+
+type ExchangeSettings struct {
+	Type       string         `json:"type"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Internal   bool           `json:"internal"`
+	Arguments  map[string]any `json:"arguments,omitempty"`
+}
+
+type Queue struct {
+	Name                   string         `json:"name"`
+	VHost                  string         `json:"vhost"`
+	Type                   string         `json:"type"`
+	Durable                bool           `json:"durable"`
+	AutoDelete             bool           `json:"auto_delete"`
+	Exclusive              bool           `json:"exclusive"`
+	Arguments              map[string]any `json:"arguments"`
+	Node                   string         `json:"node"`
+	State                  string         `json:"state"`
+	Policy                 string         `json:"policy"`
+	Consumers              int            `json:"consumers"`
+	Messages               int            `json:"messages"`
+	MessagesReady          int            `json:"messages_ready"`
+	MessagesUnacknowledged int            `json:"messages_unacknowledged"`
+}
+
+type QueueSettings struct {
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Arguments  map[string]any `json:"arguments,omitempty"`
+}
+
+const (
+	BindingDestinationQueue    = "queue"
+	BindingDestinationExchange = "exchange"
+)
+
+type Binding struct {
+	Source          string         `json:"source"`
+	VHost           string         `json:"vhost"`
+	Destination     string         `json:"destination"`
+	DestinationType string         `json:"destination_type"`
+	RoutingKey      string         `json:"routing_key"`
+	Arguments       map[string]any `json:"arguments"`
+	// PropertiesKey identifies the binding when deleting it
+	PropertiesKey string `json:"properties_key,omitempty"`
+}
+
+type Policy struct {
+	Name       string         `json:"name"`
+	VHost      string         `json:"vhost"`
+	Pattern    string         `json:"pattern"`
+	ApplyTo    string         `json:"apply-to"`
+	Priority   int            `json:"priority"`
+	Definition map[string]any `json:"definition"`
+}
+
+type PolicySettings struct {
+	Pattern string `json:"pattern"`
+	// ApplyTo is one of queues, exchanges or all
+	ApplyTo    string         `json:"apply-to,omitempty"`
+	Priority   int            `json:"priority"`
+	Definition map[string]any `json:"definition"`
+}
+
+type Connection struct {
+	Name             string         `json:"name"`
+	VHost            string         `json:"vhost"`
+	User             string         `json:"user"`
+	Node             string         `json:"node"`
+	State            string         `json:"state"`
+	Protocol         string         `json:"protocol"`
+	SSL              bool           `json:"ssl"`
+	Channels         int            `json:"channels"`
+	PeerHost         string         `json:"peer_host"`
+	PeerPort         int            `json:"peer_port"`
+	ConnectedAt      int64          `json:"connected_at"`
+	ClientProperties map[string]any `json:"client_properties"`
+}
+
+type ChannelConnection struct {
+	Name     string `json:"name"`
+	PeerHost string `json:"peer_host"`
+	PeerPort int    `json:"peer_port"`
+}
+
+type Channel struct {
+	Name                   string            `json:"name"`
+	VHost                  string            `json:"vhost"`
+	User                   string            `json:"user"`
+	Node                   string            `json:"node"`
+	Number                 int               `json:"number"`
+	State                  string            `json:"state"`
+	Confirm                bool              `json:"confirm"`
+	ConsumerCount          int               `json:"consumer_count"`
+	PrefetchCount          int               `json:"prefetch_count"`
+	MessagesUnacknowledged int               `json:"messages_unacknowledged"`
+	Connection             ChannelConnection `json:"connection_details"`
+}
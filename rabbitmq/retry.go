@@ -0,0 +1,155 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// retryCountHeader holds the number of times a message has been retried
+const retryCountHeader = "x-kapeta-retry-count"
+
+// maxRetryDelay is the largest x-message-ttl that can be set on a retry queue
+const maxRetryDelay = time.Duration(math.MaxInt32) * time.Millisecond
+
+// retryPublishTimeout bounds how long a retry waits for the broker to confirm it
+const retryPublishTimeout = 30 * time.Second
+
+// retrier re-publishes failed messages to the retry queues of a queue
+// with exponential backoff, and parks them when they run out of retries
+type retrier struct {
+	publisher *rmq.Publisher
+	queue     QueueResource
+	delays    []time.Duration
+	logger    *slog.Logger
+}
+
+// newRetrier returns nil if the queue has no dead-letter settings
+func newRetrier(conn *rmq.Conn, queue QueueResource, logger *slog.Logger) (*retrier, error) {
+	if queue.Spec.DeadLetter == nil {
+		return nil, nil
+	}
+	publisher, err := rmq.NewPublisher(
+		conn,
+		rmq.WithPublisherOptionsLogger(newRmqLogger(logger)),
+		rmq.WithPublisherOptionsConfirmMode(true),
+		rmq.WithPublisherOptionsExchangeName(deadLetterExchangeName(queue)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating retry publisher: %v", err)
+	}
+	return &retrier{
+		publisher: publisher,
+		queue:     queue,
+		delays:    retryDelays(queue.Spec.DeadLetter),
+		logger:    logger.With(logExchange, deadLetterExchangeName(queue)),
+	}, nil
+}
+
+// retry schedules the delivery for redelivery and returns the action for the original delivery.
+// The context is the context of the delivery, so shutdown stops waiting for the broker
+func (r *retrier) retry(ctx context.Context, delivery amqp.Delivery) rmq.Action {
+	spec := r.queue.Spec.DeadLetter
+	attempt := retryCount(delivery)
+	logger := r.logger.With(logDeliveryTag, delivery.DeliveryTag, "appId", delivery.AppId)
+	if len(r.delays) == 0 || attempt >= spec.MaxRetries {
+		// Dead-letter to the parking queue
+		logger.Warn("Message failed too many times. Parking it", "retries", attempt)
+		return rmq.NackDiscard
+	}
+
+	headers := rmq.Table{}
+	for key, value := range delivery.Headers {
+		headers[key] = value
+	}
+	headers[retryCountHeader] = int32(attempt + 1)
+
+	// Attempts beyond the last backoff level use the last level
+	level := min(attempt, len(r.delays)-1)
+	ctx, cancel := context.WithTimeout(ctx, retryPublishTimeout)
+	defer cancel()
+	confirmations, err := r.publisher.PublishWithDeferredConfirmWithContext(
+		ctx,
+		delivery.Body,
+		[]string{retryQueueName(r.queue, level)},
+		rmq.WithPublishOptionsHeaders(headers),
+		func(options *rmq.PublishOptions) {
+			options.ContentType = delivery.ContentType
+			options.ContentEncoding = delivery.ContentEncoding
+			options.DeliveryMode = delivery.DeliveryMode
+			options.Priority = delivery.Priority
+			options.CorrelationID = delivery.CorrelationId
+			options.ReplyTo = delivery.ReplyTo
+			options.MessageID = delivery.MessageId
+			options.Timestamp = delivery.Timestamp
+			options.Type = delivery.Type
+			options.UserID = delivery.UserId
+			options.AppID = delivery.AppId
+		},
+	)
+	if err != nil {
+		logger.Error("Failed to schedule retry of message", "error", err)
+		return rmq.NackRequeue
+	}
+	for _, confirmation := range confirmations {
+		acked, err := confirmation.WaitContext(ctx)
+		if err != nil {
+			logger.Error("Failed to schedule retry of message: not confirmed by broker", "error", err)
+			return rmq.NackRequeue
+		}
+		if !acked {
+			logger.Error("Failed to schedule retry of message: nacked by broker")
+			return rmq.NackRequeue
+		}
+	}
+	return rmq.Ack
+}
+
+// retryDelays returns the delay of each backoff level. The delay doubles for each retry
+// until it reaches MaxRetryDelay, after which all retries use the last level.
+// There is always one level if retries are enabled, even if MaxRetries is 0.
+func retryDelays(spec *DeadLetterSpec) []time.Duration {
+	if spec == nil || spec.RetryDelay <= 0 {
+		return nil
+	}
+	maxDelay := maxRetryDelay
+	if spec.MaxRetryDelay > 0 && time.Duration(spec.MaxRetryDelay)*time.Millisecond < maxDelay {
+		maxDelay = time.Duration(spec.MaxRetryDelay) * time.Millisecond
+	}
+
+	delay := min(time.Duration(spec.RetryDelay)*time.Millisecond, maxDelay)
+	delays := []time.Duration{delay}
+	for len(delays) < spec.MaxRetries && delay < maxDelay {
+		// Clamp before doubling so the delay can not overflow
+		if delay > maxDelay/2 {
+			delay = maxDelay
+		} else {
+			delay *= 2
+		}
+		delays = append(delays, delay)
+	}
+	return delays
+}
+
+func (r *retrier) close() {
+	r.publisher.Close()
+}
+
+func retryCount(delivery amqp.Delivery) int {
+	switch count := delivery.Headers[retryCountHeader].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	}
+	return 0
+}
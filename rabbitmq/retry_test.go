@@ -0,0 +1,82 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryDelays(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   *DeadLetterSpec
+		delays []time.Duration
+	}{
+		{
+			name: "no dead-letter",
+		},
+		{
+			name: "no retry delay",
+			spec: &DeadLetterSpec{MaxRetries: 0},
+		},
+		{
+			name:   "one level without max retries",
+			spec:   &DeadLetterSpec{RetryDelay: 500},
+			delays: []time.Duration{500 * time.Millisecond},
+		},
+		{
+			name:   "doubles per retry",
+			spec:   &DeadLetterSpec{MaxRetries: 4, RetryDelay: 1000},
+			delays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:   "stops at max retry delay",
+			spec:   &DeadLetterSpec{MaxRetries: 10, RetryDelay: 1000, MaxRetryDelay: 5000},
+			delays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second},
+		},
+		{
+			name:   "retry delay above max retry delay",
+			spec:   &DeadLetterSpec{MaxRetries: 3, RetryDelay: 10000, MaxRetryDelay: 5000},
+			delays: []time.Duration{5 * time.Second},
+		},
+		{
+			name:   "clamped to the max queue ttl",
+			spec:   &DeadLetterSpec{MaxRetries: 100, RetryDelay: 1 << 30},
+			delays: []time.Duration{(1 << 30) * time.Millisecond, maxRetryDelay},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delays := retryDelays(test.spec)
+			if !reflect.DeepEqual(delays, test.delays) {
+				t.Errorf("retryDelays() = %v, want %v", delays, test.delays)
+			}
+		})
+	}
+}
+
+func TestRetryCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		count   int
+	}{
+		{name: "no headers", count: 0},
+		{name: "int32", headers: amqp.Table{retryCountHeader: int32(2)}, count: 2},
+		{name: "int64", headers: amqp.Table{retryCountHeader: int64(3)}, count: 3},
+		{name: "int", headers: amqp.Table{retryCountHeader: 4}, count: 4},
+		{name: "invalid", headers: amqp.Table{retryCountHeader: "5"}, count: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count := retryCount(amqp.Delivery{Headers: test.headers})
+			if count != test.count {
+				t.Errorf("retryCount() = %d, want %d", count, test.count)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kapetacom/sdk-go-config/providers"
+	"sort"
+	"strings"
+)
+
+type RouteValidationMode string
+
+const (
+	// RouteValidationLenient logs a warning when a publish does not match the publisher spec
+	RouteValidationLenient RouteValidationMode = "lenient"
+	// RouteValidationStrict rejects publishes that do not match the publisher spec
+	RouteValidationStrict RouteValidationMode = "strict"
+	// RouteValidationDisabled does not check routing keys and headers
+	RouteValidationDisabled RouteValidationMode = "disabled"
+)
+
+// RouteValidationError is returned in strict mode when the routing key or headers
+// are not declared in the publisher spec
+type RouteValidationError struct {
+	Resource string
+	Errors   []string
+}
+
+func (e *RouteValidationError) Error() string {
+	return fmt.Sprintf("invalid routing for publisher %s: %s", e.Resource, strings.Join(e.Errors, "; "))
+}
+
+// routeValidator checks routing keys and headers against the
+// values declared in the PublisherSpec. Empty declarations allow any value.
+type routeValidator struct {
+	resourceName string
+	routeKeys    map[string]bool
+	headers      map[string]map[string]bool
+}
+
+func newRouteValidator(publisher *PublisherResource) *routeValidator {
+	validator := &routeValidator{
+		resourceName: publisher.Metadata.Name,
+	}
+	if publisher.Spec.RouteKeys != nil && len(publisher.Spec.RouteKeys.Data) > 0 {
+		validator.routeKeys = map[string]bool{}
+		for _, routeKey := range publisher.Spec.RouteKeys.Data {
+			validator.routeKeys[routeKey] = true
+		}
+	}
+	if publisher.Spec.Headers != nil && len(publisher.Spec.Headers.Data) > 0 {
+		validator.headers = map[string]map[string]bool{}
+		for _, header := range publisher.Spec.Headers.Data {
+			values := map[string]bool{}
+			for _, value := range header.Values {
+				values[value] = true
+			}
+			validator.headers[header.Name] = values
+		}
+	}
+	return validator
+}
+
+func (v *routeValidator) validate(routingKey string, headers map[string]any) error {
+	errs := make([]string, 0)
+	if v.routeKeys != nil && !v.routeKeys[routingKey] {
+		errs = append(errs, fmt.Sprintf("routing key %q is not declared", routingKey))
+	}
+	if v.headers != nil {
+		names := make([]string, 0, len(headers))
+		for name := range headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			allowed, ok := v.headers[name]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("header %q is not declared", name))
+				continue
+			}
+			value := fmt.Sprint(headers[name])
+			if len(allowed) > 0 && !allowed[value] {
+				errs = append(errs, fmt.Sprintf("header %q has undeclared value %q", name, value))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return &RouteValidationError{
+			Resource: v.resourceName,
+			Errors:   errs,
+		}
+	}
+	return nil
+}
+
+// errResourceNotFound is returned when a resource is not defined in the block
+var errResourceNotFound = errors.New("resource not found in block definition")
+
+// findPublisherResource looks up the publisher resource in the definition of the current block
+func findPublisherResource(config providers.ConfigProvider, resourceName string) (*PublisherResource, error) {
+	var definition struct {
+		Spec struct {
+			Providers []PublisherResource `json:"providers,omitempty"`
+		} `json:"spec"`
+	}
+	bytes, err := json.Marshal(config.GetBlockDefinition())
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(bytes, &definition)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding block definition: %v", err)
+	}
+	for _, provider := range definition.Spec.Providers {
+		if provider.Metadata.Name == resourceName {
+			return &provider, nil
+		}
+	}
+	return nil, fmt.Errorf("publisher %w: %s", errResourceNotFound, resourceName)
+}
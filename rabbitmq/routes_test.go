@@ -0,0 +1,113 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func testPublisherResource(t *testing.T) *PublisherResource {
+	var publisher PublisherResource
+	err := json.Unmarshal([]byte(`{
+		"metadata": {"name": "events"},
+		"spec": {
+			"routeKeys": {"data": ["order.created", "order.deleted"]},
+			"headers": {"data": [{"name": "region", "values": ["eu", "us"]}, {"name": "trace"}]}
+		}
+	}`), &publisher)
+	if err != nil {
+		t.Fatalf("error decoding publisher: %v", err)
+	}
+	return &publisher
+}
+
+func TestRouteValidator(t *testing.T) {
+	tests := []struct {
+		name       string
+		routingKey string
+		headers    map[string]any
+		errs       []string
+	}{
+		{
+			name:       "declared",
+			routingKey: "order.created",
+			headers:    map[string]any{"region": "eu", "trace": "abc"},
+		},
+		{
+			name:       "undeclared routing key",
+			routingKey: "order.updated",
+			errs:       []string{`routing key "order.updated" is not declared`},
+		},
+		{
+			name:       "undeclared header and value",
+			routingKey: "order.deleted",
+			headers:    map[string]any{"tenant": "a", "region": "asia"},
+			errs:       []string{`header "region" has undeclared value "asia"`, `header "tenant" is not declared`},
+		},
+	}
+	validator := newRouteValidator(testPublisherResource(t))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validator.validate(test.routingKey, test.headers)
+			if test.errs == nil {
+				if err != nil {
+					t.Fatalf("validate() = %v", err)
+				}
+				return
+			}
+			var routeErr *RouteValidationError
+			if !errors.As(err, &routeErr) {
+				t.Fatalf("validate() error = %v, want *RouteValidationError", err)
+			}
+			if routeErr.Resource != "events" || !reflect.DeepEqual(routeErr.Errors, test.errs) {
+				t.Errorf("validate() = %s: %v, want events: %v", routeErr.Resource, routeErr.Errors, test.errs)
+			}
+		})
+	}
+
+	t.Run("no declarations", func(t *testing.T) {
+		validator := newRouteValidator(&PublisherResource{})
+		err := validator.validate("anything", map[string]any{"any": "value"})
+		if err != nil {
+			t.Fatalf("validate() = %v", err)
+		}
+	})
+}
+
+func TestPublisherRouteValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		mode RouteValidationMode
+		fail bool
+	}{
+		{name: "strict", mode: RouteValidationStrict, fail: true},
+		{name: "lenient", mode: RouteValidationLenient},
+		{name: "disabled", mode: RouteValidationDisabled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			publisher := &Publisher[any, map[string]any, string]{
+				resourceName: "events",
+				logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+				strict:       test.mode == RouteValidationStrict,
+			}
+			if test.mode != RouteValidationDisabled {
+				publisher.routes = newRouteValidator(testPublisherResource(t))
+			}
+			err := publisher.validate(PublisherPayload[any, map[string]any, string]{RoutingKey: "order.updated"})
+			var routeErr *RouteValidationError
+			if test.fail != errors.As(err, &routeErr) {
+				t.Fatalf("validate() = %v, want failure %v", err, test.fail)
+			}
+			if !test.fail && err != nil {
+				t.Fatalf("validate() = %v", err)
+			}
+		})
+	}
+}
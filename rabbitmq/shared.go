@@ -3,88 +3,155 @@
 package rabbitmq
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/kapetacom/sdk-go-config/providers"
 	rmq "github.com/wagslane/go-rabbitmq"
-	"log"
-	"net/http"
+	"log/slog"
 )
 
+// ConnectToInstance connects to the vhost of the instance.
+// It connects as a user with access to everything in the vhost. Publishers and consumers
+// connect as the instance user whose permissions are limited to the block spec.
 func ConnectToInstance(config providers.ConfigProvider, instanceId string) (*rmq.Conn, error) {
+	return connectToInstance(config, instanceId, nil, ConnectionManagerOptions{}, slog.Default())
+}
+
+// ConnectToInstanceWithTLS connects using the TLS options instead of the TLS settings of the instance operator
+func ConnectToInstanceWithTLS(config providers.ConfigProvider, instanceId string, tlsOptions *TLSOptions) (*rmq.Conn, error) {
+	return connectToInstance(config, instanceId, nil, ConnectionManagerOptions{TLS: tlsOptions}, slog.Default())
+}
+
+func connectToInstance(config providers.ConfigProvider, instanceId string, blockSpec *BlockSpec, options ConnectionManagerOptions, logger *slog.Logger) (*rmq.Conn, error) {
 	operator, err := config.GetInstanceOperator(instanceId)
 	if err != nil {
 		return nil, fmt.Errorf("error getting instance operator: %v", err)
 	}
-	vhost, err := ensureVHost(operator, instanceId)
+	tlsOptions, err := resolveTLSOptions(operator, options.TLS)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if tlsOptions != nil {
+		tlsConfig, err = tlsOptions.TLSConfig(operator.Hostname)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring tls: %v", err)
+		}
+	}
+
+	client := NewRabbitRESTClientWithTLS(operator, tlsConfig)
+	vhost, err := ensureVHost(client, instanceId, logger)
 	if err != nil {
 		return nil, fmt.Errorf("error ensuring vhost: %v", err)
 	}
-	return connect(operator, vhost)
+	logger = logger.With(logVHost, vhost)
+
+	if blockSpec != nil {
+		err = ensurePolicies(context.Background(), client, vhost, blockSpec, options.PolicyMode, logger)
+		if err != nil {
+			return nil, fmt.Errorf("error ensuring policies: %v", err)
+		}
+	}
+
+	var credentials *providers.DefaultCredentials
+	externalAuth := tlsOptions != nil && tlsOptions.ExternalAuth
+	if !externalAuth && !options.DisableUserProvisioning {
+		credentials, err = ensureInstanceUser(context.Background(), client, instanceId, vhost, blockSpec, logger)
+		if err != nil {
+			return nil, fmt.Errorf("error ensuring user: %v", err)
+		}
+	}
+	return connect(operator, vhost, credentials, tlsOptions, tlsConfig, logger)
 }
 
-func connect(operator *providers.InstanceOperator, vhost string) (*rmq.Conn, error) {
-	if operator.Ports["amqp"].Port == 0 {
-		return nil, fmt.Errorf("amqp port not found")
+func connect(operator *providers.InstanceOperator, vhost string, credentials *providers.DefaultCredentials, tlsOptions *TLSOptions, tlsConfig *tls.Config, logger *slog.Logger) (*rmq.Conn, error) {
+	connectionConfig, err := newConnectionConfig(operator, vhost, credentials, tlsOptions, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection config: %v", err)
 	}
-	credentials := getCredentials(operator)
-	amqpURL := fmt.Sprintf("amqp://%s:%s@%s:%d",
-		credentials.Username,
-		credentials.Password,
-		operator.Hostname,
-		operator.Ports["amqp"].Port,
-	)
-	return rmq.NewConn(
-		amqpURL,
-		rmq.WithConnectionOptionsLogging,
-		rmq.WithConnectionOptionsConfig(rmq.Config{Vhost: vhost}),
+	return Connect(connectionConfig, logger)
+}
+
+// Connect opens a connection using the config
+func Connect(config *ConnectionConfig, logger *slog.Logger) (*rmq.Conn, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection config: %v", err)
+	}
+	logger = loggerOrDefault(logger)
+	conn, err := rmq.NewConn(
+		config.URL(),
+		rmq.WithConnectionOptionsLogger(newRmqLogger(logger)),
+		rmq.WithConnectionOptionsConfig(config.amqpConfig()),
 	)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", config.Redacted(), err)
+	}
+	return conn, nil
 }
 
-func ensureVHost(operator *providers.InstanceOperator, instanceId string) (string, error) {
-	vhostName := instanceId
+// instanceVHost returns the vhost used for the instance
+func instanceVHost(instanceId string) string {
+	return instanceId
+}
 
-	client := NewRabbitRESTClient(operator)
+func ensureVHost(client *RabbitRESTClient, instanceId string, logger *slog.Logger) (string, error) {
+	vhostName := instanceVHost(instanceId)
 
-	log.Printf("Checking RabbitMQ vhost: %s @ %s\n", vhostName, client.baseURL)
+	logger = logger.With(logVHost, vhostName, "url", client.baseURL)
 
-	// Check if vhost exists
-	resp, err := client.GetQueues(vhostName)
-	if err != nil {
-		return "", fmt.Errorf("error checking vhost: %v", err)
-	}
+	logger.Info("Checking RabbitMQ vhost")
 
-	if resp.StatusCode == http.StatusOK {
-		log.Printf("Found RabbitMQ vhost: %s @ %s\n", vhostName, client.baseURL)
+	// Check if vhost exists
+	ctx := context.Background()
+	_, err := client.GetVHost(ctx, vhostName)
+	if err == nil {
+		logger.Info("Found RabbitMQ vhost")
 		return vhostName, nil
 	}
 
-	if resp.StatusCode != http.StatusNotFound {
-		return "", fmt.Errorf("failed to check for existing vhost: %s @ %s. Error: %d : %s", vhostName, client.baseURL, resp.StatusCode, resp.Status)
+	if !IsNotFound(err) {
+		return "", fmt.Errorf("failed to check for existing vhost: %s @ %s. Error: %v", vhostName, client.baseURL, err)
 	}
 
 	// Create vhost
-	resp, err = client.CreateVHost(vhostName)
+	err = client.PutVHost(ctx, vhostName, VHostSettings{})
 	if err != nil {
-		return "", fmt.Errorf("error creating vhost: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to create vhost: %s @ %s. Error: %d : %s", vhostName, client.baseURL, resp.StatusCode, resp.Status)
+		return "", fmt.Errorf("failed to create vhost: %s @ %s. Error: %v", vhostName, client.baseURL, err)
 	}
 
-	log.Printf("Created RabbitMQ vhost: %s @ %s\n", vhostName, client.baseURL)
+	logger.Info("Created RabbitMQ vhost")
 	return vhostName, nil
 }
 
-func getCredentials(operator *providers.InstanceOperator) *providers.DefaultCredentials {
-	username := operator.Credentials["username"].(string)
-	password := operator.Credentials["password"].(string)
+func getCredentials(operator *providers.InstanceOperator) (*providers.DefaultCredentials, error) {
+	username, err := getCredential(operator, "username")
+	if err != nil {
+		return nil, err
+	}
+	password, err := getCredential(operator, "password")
+	if err != nil {
+		return nil, err
+	}
 
 	return &providers.DefaultCredentials{
 		Username: username,
 		Password: password,
+	}, nil
+}
+
+func getCredential(operator *providers.InstanceOperator, name string) (string, error) {
+	raw, ok := operator.Credentials[name]
+	if !ok || raw == nil {
+		return "", fmt.Errorf("instance operator credentials are missing %s", name)
+	}
+	value, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("instance operator credential %s must be a string, got %T", name, raw)
 	}
+	return value, nil
 }
 
 func toBlockSpec(instance *providers.BlockInstanceDetails) (*BlockSpec, error) {
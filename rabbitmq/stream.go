@@ -0,0 +1,57 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+type StreamOffsetType string
+
+const (
+	// StreamOffsetFirst starts at the first message available in the stream
+	StreamOffsetFirst StreamOffsetType = "first"
+	// StreamOffsetLast starts at the last chunk of messages written to the stream
+	StreamOffsetLast StreamOffsetType = "last"
+	// StreamOffsetNext only delivers messages written after the consumer started
+	StreamOffsetNext StreamOffsetType = "next"
+	// StreamOffsetTimestamp starts at the messages written at or after Timestamp
+	StreamOffsetTimestamp StreamOffsetType = "timestamp"
+	// StreamOffsetOffset starts at the message with the numeric Offset
+	StreamOffsetOffset StreamOffsetType = "offset"
+)
+
+// StreamOffset is where a consumer starts reading a stream queue.
+// See https://www.rabbitmq.com/docs/streams#consuming
+type StreamOffset struct {
+	Type      StreamOffsetType `json:"type"`
+	Timestamp time.Time        `json:"timestamp,omitempty"`
+	Offset    int64            `json:"offset,omitempty"`
+}
+
+// value returns the x-stream-offset consumer argument
+func (o *StreamOffset) value() (any, error) {
+	switch o.Type {
+	case StreamOffsetFirst, StreamOffsetLast, StreamOffsetNext:
+		return string(o.Type), nil
+	case StreamOffsetTimestamp:
+		if o.Timestamp.IsZero() {
+			return nil, fmt.Errorf("stream offset timestamp is missing")
+		}
+		return o.Timestamp, nil
+	case StreamOffsetOffset:
+		if o.Offset < 0 {
+			return nil, fmt.Errorf("invalid stream offset: %d", o.Offset)
+		}
+		return o.Offset, nil
+	}
+	return nil, fmt.Errorf("invalid stream offset type: %q", o.Type)
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/kapetacom/sdk-go-config/providers"
+	"github.com/mitchellh/mapstructure"
+	"os"
+)
+
+// TLSOptions configures TLS for AMQP (amqps) and the management API (https).
+// The options can also be provided by the instance operator in options.tls
+// or enabled by setting the port protocol to amqps / https.
+type TLSOptions struct {
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// CACert is a PEM encoded CA bundle used to verify the broker. CACertFile is read if set
+	CACert     string `json:"caCert,omitempty" mapstructure:"caCert"`
+	CACertFile string `json:"caCertFile,omitempty" mapstructure:"caCertFile"`
+	// ClientCert and ClientKey are the PEM encoded client certificate for mutual TLS
+	ClientCert     string `json:"clientCert,omitempty" mapstructure:"clientCert"`
+	ClientCertFile string `json:"clientCertFile,omitempty" mapstructure:"clientCertFile"`
+	ClientKey      string `json:"clientKey,omitempty" mapstructure:"clientKey"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty" mapstructure:"clientKeyFile"`
+	// ServerName overrides the name used to verify the broker certificate
+	ServerName         string `json:"serverName,omitempty" mapstructure:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty" mapstructure:"insecureSkipVerify"`
+	// ExternalAuth authenticates using the EXTERNAL SASL mechanism with the client certificate
+	ExternalAuth bool `json:"externalAuth,omitempty" mapstructure:"externalAuth"`
+}
+
+// resolveTLSOptions merges the operator TLS settings with the options.
+// Options take precedence over the operator. Returns nil if TLS is not enabled.
+func resolveTLSOptions(operator *providers.InstanceOperator, options *TLSOptions) (*TLSOptions, error) {
+	if options != nil {
+		if !options.Enabled {
+			return nil, nil
+		}
+		return options, nil
+	}
+
+	resolved := &TLSOptions{}
+	if rawTLS, ok := operator.Options["tls"]; ok {
+		err := mapstructure.Decode(rawTLS, resolved)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding operator tls options: %v", err)
+		}
+	}
+	if operator.Ports["amqp"].Protocol == "amqps" || operator.Ports["amqps"].Port != 0 {
+		resolved.Enabled = true
+	}
+	if !resolved.Enabled {
+		return nil, nil
+	}
+	return resolved, nil
+}
+
+// operatorTLSConfig resolves the TLS options and builds the TLS config for the operator.
+// Both are nil if TLS is not enabled.
+func operatorTLSConfig(operator *providers.InstanceOperator, options *TLSOptions) (*TLSOptions, *tls.Config, error) {
+	resolved, err := resolveTLSOptions(operator, options)
+	if err != nil || resolved == nil {
+		return nil, nil, err
+	}
+	config, err := resolved.TLSConfig(operator.Hostname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error configuring tls: %v", err)
+	}
+	return resolved, config, nil
+}
+
+// TLSConfig builds the client TLS config for the broker host
+func (o *TLSOptions) TLSConfig(hostname string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         hostname,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.ServerName != "" {
+		config.ServerName = o.ServerName
+	}
+
+	caCert, err := readPEM(o.CACert, o.CACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA certificate: %v", err)
+	}
+	if caCert != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificates found in CA bundle")
+		}
+		config.RootCAs = pool
+	}
+
+	clientCert, err := readPEM(o.ClientCert, o.ClientCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client certificate: %v", err)
+	}
+	clientKey, err := readPEM(o.ClientKey, o.ClientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client key: %v", err)
+	}
+	if clientCert != nil || clientKey != nil {
+		certificate, err := tls.X509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if o.ExternalAuth && len(config.Certificates) == 0 {
+		return nil, fmt.Errorf("external auth requires a client certificate")
+	}
+	return config, nil
+}
+
+func readPEM(value, file string) ([]byte, error) {
+	if value != "" {
+		return []byte(value), nil
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
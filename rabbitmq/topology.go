@@ -0,0 +1,287 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"fmt"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"sort"
+	"strings"
+)
+
+type topologyNode struct {
+	kind rmq.BindingDestinationType
+	name string
+}
+
+type topologyEdge struct {
+	// index is the position of the binding in the block spec, used to keep the order stable
+	index       int
+	source      *ExchangeResource
+	binding     ExchangeBindingSchema
+	destination topologyNode
+}
+
+// topology is the graph of exchanges and queues described by the bindings of a block.
+// Exchanges can be bound to other exchanges, so messages may pass through
+// several exchanges before they reach a queue.
+type topology struct {
+	exchanges map[string]*ExchangeResource
+	// order is the position of each exchange in dependency order, sources first
+	order    map[string]int
+	incoming map[topologyNode][]*topologyEdge
+	outgoing map[string][]*topologyEdge
+}
+
+// newTopology builds the graph from the bindings of the block spec.
+// Returns an error if a binding refers to an unknown exchange or the exchanges form a cycle.
+func newTopology(blockSpec *BlockSpec) (*topology, error) {
+	t := &topology{
+		exchanges: map[string]*ExchangeResource{},
+		order:     map[string]int{},
+		incoming:  map[topologyNode][]*topologyEdge{},
+		outgoing:  map[string][]*topologyEdge{},
+	}
+	for i := range blockSpec.Consumers {
+		exchange := &blockSpec.Consumers[i]
+		t.exchanges[exchange.Metadata.Name] = exchange
+	}
+
+	if blockSpec.Bindings == nil {
+		return t, t.sort(blockSpec)
+	}
+
+	index := 0
+	for _, exchangeBindings := range blockSpec.Bindings.Exchanges {
+		source, ok := t.exchanges[exchangeBindings.Exchange]
+		if !ok {
+			return nil, fmt.Errorf("exchange not found for binding: %s", exchangeBindings.Exchange)
+		}
+		for _, binding := range exchangeBindings.Bindings {
+			kind, err := bindingDestinationType(binding.Type)
+			if err != nil {
+				return nil, fmt.Errorf("binding %s to %s: %v", source.Metadata.Name, binding.Name, err)
+			}
+			if kind == rmq.BindingTypeExchange && t.exchanges[binding.Name] == nil {
+				return nil, fmt.Errorf("destination exchange not found for binding: %s to %s", source.Metadata.Name, binding.Name)
+			}
+			edge := &topologyEdge{
+				index:       index,
+				source:      source,
+				binding:     binding,
+				destination: topologyNode{kind: kind, name: binding.Name},
+			}
+			index++
+			t.incoming[edge.destination] = append(t.incoming[edge.destination], edge)
+			t.outgoing[source.Metadata.Name] = append(t.outgoing[source.Metadata.Name], edge)
+		}
+	}
+	return t, t.sort(blockSpec)
+}
+
+func bindingDestinationType(bindingType string) (rmq.BindingDestinationType, error) {
+	switch {
+	case strings.EqualFold(bindingType, string(rmq.BindingTypeQueue)):
+		return rmq.BindingTypeQueue, nil
+	case strings.EqualFold(bindingType, string(rmq.BindingTypeExchange)):
+		return rmq.BindingTypeExchange, nil
+	}
+	return "", fmt.Errorf("invalid binding type: %q", bindingType)
+}
+
+// sort orders the exchanges so every exchange comes after the exchanges bound to it
+func (t *topology) sort(blockSpec *BlockSpec) error {
+	inDegree := map[string]int{}
+	for _, edges := range t.outgoing {
+		for _, edge := range edges {
+			if edge.destination.kind == rmq.BindingTypeExchange {
+				inDegree[edge.destination.name]++
+			}
+		}
+	}
+
+	ready := make([]string, 0)
+	for _, exchange := range blockSpec.Consumers {
+		if inDegree[exchange.Metadata.Name] == 0 {
+			ready = append(ready, exchange.Metadata.Name)
+		}
+	}
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		t.order[name] = len(t.order)
+		for _, edge := range t.outgoing[name] {
+			if edge.destination.kind != rmq.BindingTypeExchange {
+				continue
+			}
+			inDegree[edge.destination.name]--
+			if inDegree[edge.destination.name] == 0 {
+				ready = append(ready, edge.destination.name)
+			}
+		}
+	}
+
+	if len(t.order) < len(t.exchanges) {
+		cycle := make([]string, 0)
+		for name := range t.exchanges {
+			if _, ok := t.order[name]; !ok {
+				cycle = append(cycle, name)
+			}
+		}
+		sort.Strings(cycle)
+		return fmt.Errorf("exchange bindings form a cycle between: %s", strings.Join(cycle, ", "))
+	}
+	return nil
+}
+
+// resolve returns the exchanges and bindings needed to route messages to the destination,
+// in dependency order. These are all exchanges with a path to the destination and,
+// if the destination is an exchange, the exchange itself and the exchanges it routes to.
+// Bindings to other queues are left to the consumers of those queues.
+func (t *topology) resolve(destinationType rmq.BindingDestinationType, destinationName string) ([]*rmq.Binding, []*rmq.ExchangeOptions, error) {
+	exchanges := map[string]bool{}
+	edges := map[*topologyEdge]bool{}
+
+	destination := topologyNode{kind: destinationType, name: destinationName}
+	if destinationType == rmq.BindingTypeExchange {
+		if t.exchanges[destinationName] == nil {
+			return nil, nil, fmt.Errorf("exchange not found: %s", destinationName)
+		}
+		exchanges[destinationName] = true
+	}
+
+	// Upstream: every exchange that can route to the destination
+	pending := []topologyNode{destination}
+	visited := map[topologyNode]bool{}
+	for len(pending) > 0 {
+		node := pending[0]
+		pending = pending[1:]
+		if visited[node] {
+			continue
+		}
+		visited[node] = true
+		for _, edge := range t.incoming[node] {
+			edges[edge] = true
+			exchanges[edge.source.Metadata.Name] = true
+			pending = append(pending, topologyNode{kind: rmq.BindingTypeExchange, name: edge.source.Metadata.Name})
+		}
+	}
+
+	// Downstream: the exchanges the destination exchange routes to
+	if destinationType == rmq.BindingTypeExchange {
+		pending = []topologyNode{destination}
+		visited = map[topologyNode]bool{}
+		for len(pending) > 0 {
+			node := pending[0]
+			pending = pending[1:]
+			if visited[node] {
+				continue
+			}
+			visited[node] = true
+			for _, edge := range t.outgoing[node.name] {
+				if edge.destination.kind != rmq.BindingTypeExchange {
+					continue
+				}
+				edges[edge] = true
+				exchanges[edge.destination.name] = true
+				pending = append(pending, edge.destination)
+			}
+		}
+	}
+
+	exchangeNames := make([]string, 0, len(exchanges))
+	for name := range exchanges {
+		exchangeNames = append(exchangeNames, name)
+	}
+	sort.Slice(exchangeNames, func(i, j int) bool {
+		return t.order[exchangeNames[i]] < t.order[exchangeNames[j]]
+	})
+	exchangeOptions := make([]*rmq.ExchangeOptions, 0, len(exchangeNames))
+	for _, name := range exchangeNames {
+		options, err := asExchange(t.exchanges[name])
+		if err != nil {
+			return nil, nil, err
+		}
+		exchangeOptions = append(exchangeOptions, &options)
+	}
+
+	sortedEdges := make([]*topologyEdge, 0, len(edges))
+	for edge := range edges {
+		sortedEdges = append(sortedEdges, edge)
+	}
+	// Bindings follow the order of their source exchange and then the order of the block spec
+	sort.Slice(sortedEdges, func(i, j int) bool {
+		left := t.order[sortedEdges[i].source.Metadata.Name]
+		right := t.order[sortedEdges[j].source.Metadata.Name]
+		if left != right {
+			return left < right
+		}
+		return sortedEdges[i].index < sortedEdges[j].index
+	})
+	bindings := make([]*rmq.Binding, 0, len(sortedEdges))
+	for _, edge := range sortedEdges {
+		binding, err := asBinding(edge.source, edge.binding, edge.destination.kind)
+		if err != nil {
+			return nil, nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+
+	return bindings, exchangeOptions, nil
+}
+
+// declarations are the exchanges, queues and bindings declared by a consumer or publisher
+type declarations struct {
+	exchanges []*rmq.ExchangeOptions
+	queues    []*rmq.QueueOptions
+	bindings  []*rmq.Binding
+}
+
+// resolveQueueDeclarations returns the declarations of a consumer of the queue.
+// The queue itself is always the first queue
+func resolveQueueDeclarations(blockSpec *BlockSpec, queue QueueResource) (*declarations, error) {
+	queueName := queue.Metadata.Name
+	queueOptions, err := asQueue(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings, exchanges, err := resolveBindings(blockSpec, rmq.BindingTypeQueue, queueName)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving bindings: %v", err)
+	}
+
+	if queueOptions.Name == "" {
+		// Exclusive queues need to have the destination name set to an empty string
+		for _, binding := range bindings {
+			if binding.DestinationType == rmq.BindingTypeQueue && binding.DestinationName == queueName {
+				binding.DestinationName = ""
+			}
+		}
+	}
+
+	deadLetterQueues, deadLetterExchanges, deadLetterBindings, err := resolveDeadLetter(queue)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving dead-letter topology: %v", err)
+	}
+
+	return &declarations{
+		exchanges: append(exchanges, deadLetterExchanges...),
+		queues:    append([]*rmq.QueueOptions{&queueOptions}, deadLetterQueues...),
+		bindings:  append(bindings, deadLetterBindings...),
+	}, nil
+}
+
+// resolveExchangeDeclarations returns the declarations of a publisher to the exchange
+func resolveExchangeDeclarations(blockSpec *BlockSpec, exchange ExchangeResource) (*declarations, error) {
+	// The exchanges include the publisher exchange itself
+	bindings, exchanges, err := resolveBindings(blockSpec, rmq.BindingTypeExchange, exchange.Metadata.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving bindings: %v", err)
+	}
+	return &declarations{
+		exchanges: exchanges,
+		bindings:  bindings,
+	}, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/kapetacom/schemas/packages/go/model"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testExchange(name string) ExchangeResource {
+	return ExchangeResource{ResourceWithSpec[ExchangeSpec]{
+		Metadata: model.ResourceMetadata{Name: name},
+		Spec:     ExchangeSpec{ExchangeType: ExchangeTypeTopic},
+	}}
+}
+
+// testBlockSpec creates a block with the exchanges and bindings given as source -> destination.
+// Destinations starting with q are queues.
+func testBlockSpec(exchanges []string, bindings ...string) *BlockSpec {
+	blockSpec := &BlockSpec{Bindings: &BindingsSchema{}}
+	for _, name := range exchanges {
+		blockSpec.Consumers = append(blockSpec.Consumers, testExchange(name))
+	}
+	for _, binding := range bindings {
+		source, destination, _ := strings.Cut(binding, " -> ")
+		bindingType := "exchange"
+		if strings.HasPrefix(destination, "q") {
+			bindingType = "queue"
+		}
+		blockSpec.Bindings.Exchanges = append(blockSpec.Bindings.Exchanges, ExchangeBindingsSchema{
+			Exchange: source,
+			Bindings: []ExchangeBindingSchema{{Name: destination, Type: bindingType, Routing: destination}},
+		})
+	}
+	return blockSpec
+}
+
+func TestTopologyCycle(t *testing.T) {
+	tests := []struct {
+		name      string
+		exchanges []string
+		bindings  []string
+		err       string
+	}{
+		{
+			name:      "two exchanges",
+			exchanges: []string{"a", "b", "c"},
+			bindings:  []string{"a -> b", "b -> a", "c -> a"},
+			err:       "exchange bindings form a cycle between: a, b",
+		},
+		{
+			name:      "self binding",
+			exchanges: []string{"a", "b"},
+			bindings:  []string{"a -> b", "b -> b"},
+			err:       "exchange bindings form a cycle between: b",
+		},
+		{
+			name:      "downstream of a cycle",
+			exchanges: []string{"d", "c", "b", "a"},
+			bindings:  []string{"a -> b", "b -> c", "c -> b", "c -> d", "d -> queue"},
+			err:       "exchange bindings form a cycle between: b, c, d",
+		},
+		{
+			name:      "unknown destination",
+			exchanges: []string{"a"},
+			bindings:  []string{"a -> b"},
+			err:       "destination exchange not found for binding: a to b",
+		},
+		{
+			name:      "unknown source",
+			exchanges: []string{"a"},
+			bindings:  []string{"b -> queue"},
+			err:       "exchange not found for binding: b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newTopology(testBlockSpec(test.exchanges, test.bindings...))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("newTopology() = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestTopologyResolve(t *testing.T) {
+	// The exchanges and bindings are listed in reverse so the order has to come from the graph
+	blockSpec := testBlockSpec([]string{"other", "d", "c", "b", "a"},
+		"d -> queue",
+		"c -> d",
+		"b -> d",
+		"a -> c",
+		"a -> b",
+		"a -> queue-a",
+		"other -> queue-other",
+	)
+	topology, err := newTopology(blockSpec)
+	if err != nil {
+		t.Fatalf("newTopology() = %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		destinationType rmq.BindingDestinationType
+		destination     string
+		exchanges       []string
+		bindings        []string
+	}{
+		{
+			name:            "queue behind several exchanges",
+			destinationType: rmq.BindingTypeQueue,
+			destination:     "queue",
+			exchanges:       []string{"a", "c", "b", "d"},
+			bindings:        []string{"a -> c", "a -> b", "c -> d", "b -> d", "d -> queue"},
+		},
+		{
+			name:            "queue bound to a source exchange",
+			destinationType: rmq.BindingTypeQueue,
+			destination:     "queue-a",
+			exchanges:       []string{"a"},
+			bindings:        []string{"a -> queue-a"},
+		},
+		{
+			name:            "exchange in the middle",
+			destinationType: rmq.BindingTypeExchange,
+			destination:     "c",
+			exchanges:       []string{"a", "c", "d"},
+			bindings:        []string{"a -> c", "c -> d"},
+		},
+		{
+			name:            "unbound exchange",
+			destinationType: rmq.BindingTypeExchange,
+			destination:     "other",
+			exchanges:       []string{"other"},
+			bindings:        []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bindings, exchanges, err := topology.resolve(test.destinationType, test.destination)
+			if err != nil {
+				t.Fatalf("resolve() = %v", err)
+			}
+			exchangeNames := make([]string, 0, len(exchanges))
+			for _, exchange := range exchanges {
+				exchangeNames = append(exchangeNames, exchange.Name)
+			}
+			if !reflect.DeepEqual(exchangeNames, test.exchanges) {
+				t.Errorf("exchanges = %v, want %v", exchangeNames, test.exchanges)
+			}
+			bindingNames := make([]string, 0, len(bindings))
+			for _, binding := range bindings {
+				bindingNames = append(bindingNames, fmt.Sprintf("%s -> %s", binding.ExchangeName, binding.DestinationName))
+				if binding.RoutingKey != binding.DestinationName {
+					t.Errorf("routing key of %s -> %s = %s", binding.ExchangeName, binding.DestinationName, binding.RoutingKey)
+				}
+			}
+			if !reflect.DeepEqual(bindingNames, test.bindings) {
+				t.Errorf("bindings = %v, want %v", bindingNames, test.bindings)
+			}
+		})
+	}
+
+	_, _, err = topology.resolve(rmq.BindingTypeExchange, "missing")
+	if err == nil || err.Error() != "exchange not found: missing" {
+		t.Errorf("resolve() = %v, want exchange not found", err)
+	}
+}
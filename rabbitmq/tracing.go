@@ -0,0 +1,115 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"context"
+	amqp "github.com/rabbitmq/amqp091-go"
+	rmq "github.com/wagslane/go-rabbitmq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/kapetacom/sdk-go-rabbitmq"
+
+// instanceIdKey is the span attribute holding the Kapeta instance id
+const instanceIdKey = attribute.Key("kapeta.instance_id")
+
+// TracingOptions configures trace propagation for publishers and consumers.
+// The global tracer provider and the W3C trace context propagator are used by default.
+type TracingOptions struct {
+	TracerProvider trace.TracerProvider
+	Propagator     propagation.TextMapPropagator
+}
+
+type tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	instanceId string
+}
+
+func newTracer(options TracingOptions, instanceId string) *tracer {
+	provider := options.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	propagator := options.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	return &tracer{
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagator,
+		instanceId: instanceId,
+	}
+}
+
+// startPublish starts a producer span and injects its context into the headers
+func (t *tracer) startPublish(ctx context.Context, exchange, routingKey string, headers rmq.Table) (context.Context, trace.Span) {
+	ctx, span := t.tracer.Start(ctx, exchange+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationPublish,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(routingKey),
+			instanceIdKey.String(t.instanceId),
+		),
+	)
+	t.propagator.Inject(ctx, tableCarrier(headers))
+	return ctx, span
+}
+
+// startConsume extracts the trace context from the delivery and starts a consumer span
+func (t *tracer) startConsume(ctx context.Context, queue string, delivery amqp.Delivery) (context.Context, trace.Span) {
+	ctx = t.propagator.Extract(ctx, tableCarrier(delivery.Headers))
+	return t.tracer.Start(ctx, queue+" deliver",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationDeliver,
+			semconv.MessagingDestinationName(queue),
+			semconv.MessagingDestinationPublishName(delivery.Exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(delivery.RoutingKey),
+			semconv.MessagingMessageID(delivery.MessageId),
+			semconv.MessagingMessageBodySize(len(delivery.Body)),
+			instanceIdKey.String(t.instanceId),
+		),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tableCarrier adapts AMQP headers to a propagation.TextMapCarrier
+type tableCarrier map[string]any
+
+func (c tableCarrier) Get(key string) string {
+	value, ok := c[key].(string)
+	if !ok {
+		return ""
+	}
+	return value
+}
+
+func (c tableCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c tableCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
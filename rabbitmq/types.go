@@ -40,6 +40,12 @@ type ExchangeSpec struct {
 	ExchangeType string `json:"exchangeType"`
 	Durable      bool   `json:"durable,omitempty"`
 	AutoDelete   bool   `json:"autoDelete,omitempty"`
+	// DelayedType is the routing type of x-delayed-message exchanges. Defaults to direct
+	DelayedType string `json:"delayedType,omitempty"`
+	// Arguments are passed to the broker when declaring the exchange
+	Arguments Arguments `json:"arguments,omitempty"`
+	// Policy is applied to the exchange through the management API
+	Policy *PolicySpec `json:"policy,omitempty"`
 }
 
 type QueueSpec struct {
@@ -47,6 +53,73 @@ type QueueSpec struct {
 	Durable    bool `json:"durable,omitempty"`
 	Exclusive  bool `json:"exclusive,omitempty"`
 	AutoDelete bool `json:"autoDelete,omitempty"`
+	// QueueType is classic, quorum or stream. Defaults to classic
+	QueueType string `json:"queueType,omitempty"`
+	// DeliveryLimit is the max number of redeliveries before a message is dropped or dead-lettered. Quorum queues only
+	DeliveryLimit int `json:"deliveryLimit,omitempty"`
+	// MaxAge is the retention of a stream, e.g. 7D, 12h or 30m. Streams only
+	MaxAge string `json:"maxAge,omitempty"`
+	// MaxLengthBytes is the max total size of the messages in the queue
+	MaxLengthBytes int `json:"maxLengthBytes,omitempty"`
+	// StreamOffset is where consumers start reading a stream. Defaults to next
+	StreamOffset *StreamOffset `json:"streamOffset,omitempty"`
+	// Arguments are passed to the broker when declaring the queue.
+	// Arguments set by the other fields can not be repeated here
+	Arguments Arguments `json:"arguments,omitempty"`
+	// Consumer tuning. Zero values use the defaults
+	Concurrency    int  `json:"concurrency,omitempty"`
+	PrefetchCount  int  `json:"prefetchCount,omitempty"`
+	PrefetchSize   int  `json:"prefetchSize,omitempty"`
+	PrefetchGlobal bool `json:"prefetchGlobal,omitempty"`
+	// DeadLetter enables dead-lettering, retries and parking of failed messages.
+	// Without it a failed message is requeued once and then discarded
+	DeadLetter *DeadLetterSpec `json:"deadLetter,omitempty"`
+	// Policy is applied to the queue through the management API
+	Policy *PolicySpec `json:"policy,omitempty"`
+}
+
+// PolicySpec declares the RabbitMQ policy of a queue or exchange.
+// See https://www.rabbitmq.com/docs/parameters#policies
+// Zero values are left out of the policy.
+type PolicySpec struct {
+	// Priority of the policy. Policies with a higher priority take precedence
+	Priority int `json:"priority,omitempty"`
+	// MessageTTL in ms. Queues only
+	MessageTTL int `json:"messageTtl,omitempty"`
+	// Expires deletes the queue after it has been unused for this many ms. Queues only
+	Expires int `json:"expires,omitempty"`
+	// MaxLength is the max number of messages in the queue. Queues only
+	MaxLength int `json:"maxLength,omitempty"`
+	// MaxLengthBytes is the max total body size of the messages in the queue. Queues only
+	MaxLengthBytes int `json:"maxLengthBytes,omitempty"`
+	// Overflow is drop-head, reject-publish or reject-publish-dlx. Queues only
+	Overflow string `json:"overflow,omitempty"`
+	// DeliveryLimit is the max number of redeliveries in quorum queues. Queues only
+	DeliveryLimit int `json:"deliveryLimit,omitempty"`
+	// HAMode, HAParams and HASyncMode configure classic queue mirroring. Queues only
+	HAMode     string `json:"haMode,omitempty"`
+	HAParams   any    `json:"haParams,omitempty"`
+	HASyncMode string `json:"haSyncMode,omitempty"`
+	// AlternateExchange receives messages that can not be routed. Exchanges only
+	AlternateExchange string `json:"alternateExchange,omitempty"`
+	// Definition holds any other policy keys as they are named by RabbitMQ
+	Definition map[string]any `json:"definition,omitempty"`
+}
+
+type DeadLetterSpec struct {
+	// Exchange is the dead-letter exchange. Defaults to <queue>.dlx
+	Exchange string `json:"exchange,omitempty"`
+	// RoutingKey used when dead-lettering messages to the parking queue. Defaults to the queue name
+	RoutingKey string `json:"routingKey,omitempty"`
+	// MaxRetries is the max number of times a failed message is retried before it is parked.
+	// Requires a RetryDelay
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// RetryDelay in ms before a failed message is redelivered the first time.
+	// The delay is doubled for each retry, using a retry queue per delay.
+	// If 0 failed messages are parked right away
+	RetryDelay int `json:"retryDelay,omitempty"`
+	// MaxRetryDelay in ms caps the exponential backoff. Defaults to the max queue TTL of about 24 days
+	MaxRetryDelay int `json:"maxRetryDelay,omitempty"`
 }
 
 type HeaderBindings struct {
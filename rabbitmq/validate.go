@@ -0,0 +1,183 @@
+// Copyright 2023 Kapeta Inc.
+// SPDX-License-Identifier: MIT
+
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kapetacom/schemas/packages/go/model"
+	"strings"
+	"time"
+)
+
+// PayloadValidationError is returned when a payload does not match the entity
+// declared as the payload type of the exchange or queue
+type PayloadValidationError struct {
+	Entity string
+	Errors []string
+}
+
+func (e *PayloadValidationError) Error() string {
+	return fmt.Sprintf("invalid payload for %s: %s", e.Entity, strings.Join(e.Errors, "; "))
+}
+
+type payloadValidator struct {
+	entity   model.Entity
+	entities map[string]model.Entity
+}
+
+// newPayloadValidator returns nil if the payload type has no structure to validate against
+func newPayloadValidator(payloadType PayloadType, entities *model.EntityList) *payloadValidator {
+	structure := payloadType.Structure
+	if len(structure.Properties) == 0 && len(structure.Values) == 0 {
+		return nil
+	}
+	validator := &payloadValidator{
+		entity:   structure,
+		entities: map[string]model.Entity{},
+	}
+	if entities != nil {
+		for _, entity := range entities.Types {
+			validator.entities[entity.Name] = entity
+		}
+	}
+	return validator
+}
+
+// validate checks the JSON representation of the payload against the entity.
+// Use validateJSON for received messages, since missing fields are set to their
+// zero value when the message is decoded and would pass the required check.
+func (v *payloadValidator) validate(payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding payload for validation: %v", err)
+	}
+	return v.validateJSON(data)
+}
+
+// validateJSON checks the JSON encoded payload against the entity
+func (v *payloadValidator) validateJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	err := decoder.Decode(&value)
+	if err != nil {
+		return fmt.Errorf("error decoding payload for validation: %v", err)
+	}
+
+	errs := make([]string, 0)
+	v.validateEntity("$", v.entity, value, &errs)
+	if len(errs) > 0 {
+		return &PayloadValidationError{
+			Entity: v.entity.Name,
+			Errors: errs,
+		}
+	}
+	return nil
+}
+
+func (v *payloadValidator) validateEntity(path string, entity model.Entity, value any, errs *[]string) {
+	switch entity.Type {
+	case model.Native:
+		return
+	case model.Enum:
+		text, ok := value.(string)
+		if !ok {
+			*errs = append(*errs, fmt.Sprintf("%s must be one of %s", path, strings.Join(entity.Values, ", ")))
+			return
+		}
+		for _, allowed := range entity.Values {
+			if text == allowed {
+				return
+			}
+		}
+		*errs = append(*errs, fmt.Sprintf("%s has invalid value %q. Must be one of %s", path, text, strings.Join(entity.Values, ", ")))
+		return
+	}
+
+	object, ok := value.(map[string]any)
+	if !ok {
+		*errs = append(*errs, fmt.Sprintf("%s must be an object", path))
+		return
+	}
+
+	for name, property := range entity.Properties {
+		propertyPath := path + "." + name
+		propertyValue, found := object[name]
+		if !found || propertyValue == nil {
+			if property.Required != nil && *property.Required {
+				*errs = append(*errs, fmt.Sprintf("%s is required", propertyPath))
+			}
+			continue
+		}
+		typeName := ""
+		if property.Ref != nil {
+			typeName = *property.Ref
+		} else if property.Type != nil {
+			typeName = *property.Type
+		}
+		v.validateType(propertyPath, typeName, propertyValue, errs)
+	}
+}
+
+func (v *payloadValidator) validateType(path, typeName string, value any, errs *[]string) {
+	if strings.HasSuffix(typeName, "[]") {
+		items, ok := value.([]any)
+		if !ok {
+			*errs = append(*errs, fmt.Sprintf("%s must be an array", path))
+			return
+		}
+		for i, item := range items {
+			v.validateType(fmt.Sprintf("%s[%d]", path, i), strings.TrimSuffix(typeName, "[]"), item, errs)
+		}
+		return
+	}
+
+	switch strings.ToLower(typeName) {
+	case "", "any", "object":
+		return
+	case "string", "text", "char":
+		if _, ok := value.(string); !ok {
+			*errs = append(*errs, fmt.Sprintf("%s must be a string", path))
+		}
+	case "integer", "int", "long", "short", "byte":
+		number, ok := value.(json.Number)
+		if !ok {
+			*errs = append(*errs, fmt.Sprintf("%s must be an integer", path))
+			return
+		}
+		if _, err := number.Int64(); err != nil {
+			*errs = append(*errs, fmt.Sprintf("%s must be an integer", path))
+		}
+	case "number", "float", "double", "decimal":
+		if _, ok := value.(json.Number); !ok {
+			*errs = append(*errs, fmt.Sprintf("%s must be a number", path))
+		}
+	case "boolean", "bool":
+		if _, ok := value.(bool); !ok {
+			*errs = append(*errs, fmt.Sprintf("%s must be a boolean", path))
+		}
+	case "date", "datetime", "instant":
+		switch date := value.(type) {
+		case json.Number:
+			// epoch timestamp
+		case string:
+			if _, err := time.Parse(time.RFC3339, date); err != nil {
+				if _, err := time.Parse(time.DateOnly, date); err != nil {
+					*errs = append(*errs, fmt.Sprintf("%s must be a date", path))
+				}
+			}
+		default:
+			*errs = append(*errs, fmt.Sprintf("%s must be a date", path))
+		}
+	default:
+		entity, ok := v.entities[typeName]
+		if !ok {
+			// Unknown types can not be validated
+			return
+		}
+		v.validateEntity(path, entity, value, errs)
+	}
+}